@@ -0,0 +1,228 @@
+package main
+
+import (
+	"chirpy/internal/auth"
+	"chirpy/internal/database"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+)
+
+// runCommand runs one of the maintenance subcommands instead of the server
+func runCommand(name string, args []string) error {
+	switch name {
+	case "import-json":
+		return importJSON(args)
+	case "restore":
+		return restore(args)
+	case "migrate":
+		return migrate(args)
+	case "generate-key":
+		return generateKey(args)
+	case "generate-signing-key":
+		return generateSigningKey(args)
+	case "grant-role":
+		return changeRole(args, true)
+	case "revoke-role":
+		return changeRole(args, false)
+	case "reset-mfa":
+		return resetMFA(args)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+// importJSON loads an existing database.json into the sqlite database at DB_PATH
+func importJSON(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: chirpy import-json <database.json>")
+	}
+	db, err := database.NewSQLiteDB(databasePath("chirpy.db"))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	options, err := fileOptions()
+	if err != nil {
+		return err
+	}
+	err = db.ImportJSON(args[0], options...)
+	if err != nil {
+		return err
+	}
+	log.Printf("Imported %s", args[0])
+	return nil
+}
+
+// restore installs a snapshot taken through /admin/snapshot as the JSON database
+func restore(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: chirpy restore <snapshot.json>")
+	}
+	if backend := os.Getenv("DB_BACKEND"); backend != "" && backend != "json" {
+		return fmt.Errorf("restore only works with the json backend, not %q", backend)
+	}
+	options, err := fileOptions()
+	if err != nil {
+		return err
+	}
+	path := databasePath("database.json")
+	err = database.Restore(args[0], path, options...)
+	if err != nil {
+		return err
+	}
+	log.Printf("Restored %s from %s", path, args[0])
+	return nil
+}
+
+// migrate upgrades the JSON database to the schema version of this build.
+// With --dry-run it lists the pending migrations and checks that they
+// apply cleanly without writing anything.
+func migrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "list the pending migrations without applying them")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return errors.New("usage: chirpy migrate [--dry-run]")
+	}
+	if backend := os.Getenv("DB_BACKEND"); backend != "" && backend != "json" {
+		return fmt.Errorf("migrate only works with the json backend, not %q", backend)
+	}
+
+	options, err := fileOptions()
+	if err != nil {
+		return err
+	}
+	path := databasePath("database.json")
+	pending, err := database.PendingMigrations(path, options...)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		log.Printf("%s is up to date", path)
+		return nil
+	}
+	for _, description := range pending {
+		log.Printf("Pending: %s", description)
+	}
+
+	// a read-only database migrates in memory only
+	var db *database.DB
+	if *dryRun {
+		db, err = database.NewReadOnlyDB(path, options...)
+	} else {
+		db, err = database.NewDB(path, options...)
+	}
+	if err != nil {
+		return err
+	}
+	err = db.Close()
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		log.Printf("%d migrations would be applied to %s", len(pending), path)
+	} else {
+		log.Printf("Applied %d migrations to %s", len(pending), path)
+	}
+	return nil
+}
+
+// generateKey prints a new key for DB_ENCRYPTION_KEY or DB_ENCRYPTION_KEYFILE
+func generateKey(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: chirpy generate-key")
+	}
+	key, err := database.NewKey()
+	if err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
+
+// generateSigningKey prints a new PEM encoded private key for a
+// private_key_file entry of JWT_KEYS_FILE
+func generateSigningKey(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: chirpy generate-signing-key <EdDSA|RS256>")
+	}
+	key, err := auth.GeneratePrivateKey(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(key))
+	return nil
+}
+
+// changeRole grants a role to the user with an email address, or revokes
+// it. Roles take effect on the user's next request.
+func changeRole(args []string, grant bool) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: chirpy grant-role|revoke-role <email> <%s>", strings.Join(database.Roles, "|"))
+	}
+	email, role := args[0], args[1]
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	if closer, ok := db.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	user, err := db.GetUserByEmail(email)
+	if err != nil {
+		return fmt.Errorf("%s: %w", email, err)
+	}
+	roles := slices.DeleteFunc(slices.Clone(user.Roles), func(r string) bool { return r == role })
+	if grant {
+		roles = append(roles, role)
+	}
+	user, err = db.SetUserRoles(user.Id, roles)
+	if err != nil {
+		return err
+	}
+	if len(user.Roles) == 0 {
+		log.Printf("%s has no roles now", email)
+	} else {
+		log.Printf("%s now has the roles: %s", email, strings.Join(user.Roles, ", "))
+	}
+	return nil
+}
+
+// resetMFA turns off the two-factor authentication of the user with an
+// email address, for users who lost both their authenticator and their
+// recovery codes
+func resetMFA(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: chirpy reset-mfa <email>")
+	}
+	email := args[0]
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	if closer, ok := db.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	user, err := db.GetUserByEmail(email)
+	if err != nil {
+		return fmt.Errorf("%s: %w", email, err)
+	}
+	err = db.DisableMFA(user.Id)
+	if err != nil {
+		return fmt.Errorf("%s: %w", email, err)
+	}
+	log.Printf("%s can log in with their password alone now", email)
+	return nil
+}
@@ -1,50 +1,58 @@
 package handlers
 
 import (
+	"chirpy/internal/auth"
+	"chirpy/internal/database"
 	"chirpy/utils"
-	"fmt"
+	"errors"
 	"net/http"
 	"strings"
 	"time"
-
-	"github.com/golang-jwt/jwt/v5"
 )
 
 func (a *ApiConfig) generateAccessToken(w http.ResponseWriter, r *http.Request) {
 	type ResponseBody struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+		Scope        string `json:"scope"`
 	}
-	authorizationToken := strings.Split(r.Header.Get("Authorization"), " ")[1]
-	user, err := a.Database.GetUserByRefreshToken(string(authorizationToken))
+	authorizationToken, err := auth.Credentials(r.Header.Get("Authorization"), auth.SchemeBearer)
 	if err != nil {
-		utils.RespondWithError(w, http.StatusInternalServerError, "something went wrong in the database")
+		respondWithAuthError(w, auth.SchemeBearer, err)
 		return
 	}
-	if len(user.Email) == 0 {
-		utils.RespondWithError(w, http.StatusUnauthorized, "this user couldn't be authorized")
+	login, err := a.Database.RotateRefreshToken(authorizationToken, device(r))
+	switch {
+	case errors.Is(err, database.ErrRefreshTokenReused),
+		errors.Is(err, database.ErrRefreshTokenInvalid),
+		errors.Is(err, database.ErrRefreshTokenExpired):
+		respondWithAuthError(w, auth.SchemeBearer, err)
+		return
+	case err != nil:
+		utils.RespondWithError(w, http.StatusInternalServerError, "something went wrong in the database")
 		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    "chirpy",
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Duration(time.Hour))),
-		Subject:   fmt.Sprint(user.Id),
-	})
-	tokenString, err := token.SignedString([]byte(a.JwtSecret))
+	tokenString, granted, err := a.accessToken(login, time.Hour)
 	if err != nil {
 		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 	response := ResponseBody{
-		Token: tokenString,
+		Token:        tokenString,
+		RefreshToken: login.RefreshToken,
+		Scope:        strings.Join(granted, " "),
 	}
 	utils.RespondWithJson(w, http.StatusOK, response)
 }
 
 func (a *ApiConfig) revokeUser(w http.ResponseWriter, r *http.Request) {
-	authorizationToken := strings.Split(r.Header.Get("Authorization"), " ")[1]
-	err := a.Database.RevokeRefreshToken(string(authorizationToken))
+	authorizationToken, err := auth.Credentials(r.Header.Get("Authorization"), auth.SchemeBearer)
+	if err != nil {
+		respondWithAuthError(w, auth.SchemeBearer, err)
+		return
+	}
+	err = a.Database.RevokeRefreshToken(authorizationToken)
 	if err != nil {
 		utils.RespondWithError(w, http.StatusInternalServerError, "something went wrong in the database")
 		return
@@ -53,21 +61,33 @@ func (a *ApiConfig) revokeUser(w http.ResponseWriter, r *http.Request) {
 	utils.RespondWithJson(w, http.StatusNoContent, nil)
 }
 
-// Create a helper function to parse the JWT
-func (a *ApiConfig) parseJWT(r *http.Request) (*jwt.RegisteredClaims, error) {
-	authHeader := r.Header.Get("Authorization")
-	if len(authHeader) == 0 {
-		return nil, fmt.Errorf("missing authorization header")
-	}
-	tokenString := strings.Split(authHeader, " ")[1]
-	claims := &jwt.RegisteredClaims{}
-
-	_, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
-		return []byte(a.JwtSecret), nil
-	})
+// accessToken signs an access token for a login. It gets the scopes its
+// session asked for that the user may have, which it returns too.
+func (a *ApiConfig) accessToken(login database.Login, lifetime time.Duration) (string, []string, error) {
+	scopes := auth.GrantedScopes(login.Session.Scopes, login.User.HasRole(database.RoleAdmin))
+	token, err := a.Tokens.NewAccessToken(string(login.User.Id), login.User.Roles, scopes, lifetime)
 	if err != nil {
-		return nil, fmt.Errorf("invalid token: %w", err)
+		return "", nil, err
 	}
+	return token, scopes, nil
+}
 
-	return claims, nil
+// respondWithAuthError rejects a request whose credentials are missing or
+// invalid, with a WWW-Authenticate challenge telling the client how to
+// authenticate (RFC 6750). Headers that can't be parsed are bad requests.
+func respondWithAuthError(w http.ResponseWriter, scheme string, err error) {
+	status := http.StatusUnauthorized
+	challenge := scheme + ` realm="chirpy"`
+	switch {
+	case errors.Is(err, auth.ErrTokenMissing), errors.Is(err, auth.ErrWrongScheme):
+		// clients that didn't try this scheme get no error code
+	case errors.Is(err, auth.ErrHeaderMalformed):
+		status = http.StatusBadRequest
+		challenge += `, error="invalid_request"`
+	default:
+		challenge += `, error="invalid_token"`
+	}
+	challenge += `, error_description="` + err.Error() + `"`
+	w.Header().Set("WWW-Authenticate", challenge)
+	utils.RespondWithError(w, status, err.Error())
 }
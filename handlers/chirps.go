@@ -4,47 +4,62 @@ import (
 	"chirpy/internal/database"
 	"chirpy/utils"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"sort"
-	"strconv"
 	"strings"
 )
 
 func (a *ApiConfig) deleteSingleChirp(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(r.PathValue("chirpId"))
-	if err != nil {
-		utils.RespondWithError(w, http.StatusBadRequest, "provide correct id")
-		return
-	}
-	claims, err := a.parseJWT(r)
-	if err != nil {
-		utils.RespondWithError(w, http.StatusUnauthorized, "the user is not authorized")
+	id := database.ID(r.PathValue("chirpId"))
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
 		return
 	}
-	userId, err := claims.GetSubject()
-	if err != nil {
-		utils.RespondWithError(w, http.StatusBadRequest, "the token is malformed")
+	err := a.Database.DeleteChirp(id, principal.UserId, principal.HasRole(database.RoleModerator))
+	switch {
+	case errors.Is(err, database.ErrChirpNotFound):
+		utils.RespondWithError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, database.ErrNotChirpAuthor):
+		utils.RespondWithError(w, http.StatusForbidden, err.Error())
+	case err != nil:
+		utils.RespondWithError(w, http.StatusInternalServerError, "Internal server error")
+	default:
+		utils.RespondWithJson(w, http.StatusNoContent, nil)
 	}
-	userIdInt, err := strconv.Atoi(userId)
-	if err != nil {
-		utils.RespondWithError(w, http.StatusInternalServerError, "sorry I messed up")
+}
+
+func (a *ApiConfig) restoreSingleChirp(w http.ResponseWriter, r *http.Request) {
+	id := database.ID(r.PathValue("chirpId"))
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
 	}
-	err = a.Database.DeleteChirp(id, userIdInt)
-	if err != nil {
+	chirp, err := a.Database.RestoreChirp(id, principal.UserId, principal.HasRole(database.RoleModerator))
+	switch {
+	case errors.Is(err, database.ErrChirpNotFound):
+		utils.RespondWithError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, database.ErrNotChirpAuthor), errors.Is(err, database.ErrChirpModerated):
 		utils.RespondWithError(w, http.StatusForbidden, err.Error())
-		return
+	case errors.Is(err, database.ErrChirpNotDeleted):
+		utils.RespondWithError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, database.ErrRestoreWindowPassed):
+		utils.RespondWithError(w, http.StatusGone, err.Error())
+	case err != nil:
+		utils.RespondWithError(w, http.StatusInternalServerError, "Internal server error")
+	default:
+		utils.RespondWithJson(w, http.StatusOK, chirp)
 	}
-	utils.RespondWithJson(w, http.StatusNoContent, nil)
 }
 
 func (a *ApiConfig) fetchSingleChirp(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(r.PathValue("chirpId"))
-	if err != nil {
-		utils.RespondWithError(w, http.StatusBadRequest, "provide correct id")
+	id := database.ID(r.PathValue("chirpId"))
+	chirp, err := a.Database.GetSingleChirp(id)
+	if errors.Is(err, database.ErrChirpDeleted) {
+		utils.RespondWithError(w, http.StatusGone, "this chirp was deleted")
 		return
 	}
-	chirp, err := a.Database.GetSingleChirp(id)
 	if err != nil {
 		utils.RespondWithError(w, http.StatusNotFound, "not found")
 		return
@@ -57,6 +72,11 @@ func (a *ApiConfig) createChirps(w http.ResponseWriter, r *http.Request) {
 		Body string `json:"body"`
 	}
 
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
+
 	bodyJson := RequestBody{}
 	err := json.NewDecoder(r.Body).Decode(&bodyJson)
 	if err != nil {
@@ -68,22 +88,6 @@ func (a *ApiConfig) createChirps(w http.ResponseWriter, r *http.Request) {
 		utils.RespondWithError(w, http.StatusBadRequest, "Chirp is too long")
 		return
 	}
-	claims, err := a.parseJWT(r)
-	if err != nil {
-		utils.RespondWithError(w, http.StatusUnauthorized, "the user is not authorized")
-		return
-	}
-	id, err := claims.GetSubject()
-	if err != nil {
-		utils.RespondWithError(w, http.StatusBadRequest, "the token is malformed")
-		return
-	}
-
-	idInt, err := strconv.Atoi(id)
-	if err != nil {
-		utils.RespondWithError(w, http.StatusBadRequest, "the token doesn't have the subject")
-		return
-	}
 
 	chunks := strings.Split(bodyJson.Body, " ")
 	profanes := []string{"kerfuffle", "sharbert", "fornax"}
@@ -95,7 +99,7 @@ func (a *ApiConfig) createChirps(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	chirp, err := a.Database.CreateChirp(strings.Join(chunks, " "), idInt)
+	chirp, err := a.Database.CreateChirp(strings.Join(chunks, " "), principal.UserId)
 	if err != nil {
 		utils.RespondWithError(w, 500, err.Error())
 		return
@@ -103,43 +107,57 @@ func (a *ApiConfig) createChirps(w http.ResponseWriter, r *http.Request) {
 	utils.RespondWithJson(w, 201, chirp)
 }
 
+// chirpSortKeys are the orderings fetchChirps accepts in sort_by; ties on
+// a timestamp are broken by id so the order is stable between requests
+var chirpSortKeys = map[string]func(a, b database.Chirp) bool{
+	"":   chirpIdLess,
+	"id": chirpIdLess,
+	"created_at": func(a, b database.Chirp) bool {
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return chirpIdLess(a, b)
+	},
+	"updated_at": func(a, b database.Chirp) bool {
+		if !a.UpdatedAt.Equal(b.UpdatedAt) {
+			return a.UpdatedAt.Before(b.UpdatedAt)
+		}
+		return chirpIdLess(a, b)
+	},
+}
+
+func chirpIdLess(a, b database.Chirp) bool {
+	return a.Id.Less(b.Id)
+}
+
 func (a *ApiConfig) fetchChirps(w http.ResponseWriter, r *http.Request) {
-	chirps, err := a.Database.GetChirps()
+	var chirps []database.Chirp
+	var err error
+	authorId := r.URL.Query().Get("author_id")
+	if len(authorId) > 0 {
+		chirps, err = a.Database.GetChirpsByAuthor(database.ID(authorId))
+	} else {
+		chirps, err = a.Database.GetChirps()
+	}
 	if err != nil {
 		utils.RespondWithError(w, http.StatusInternalServerError, "Internal server error")
 		return
 	}
-	authorId := r.URL.Query().Get("author_id")
-	sortQuery := r.URL.Query().Get("sort")
-	if len(sortQuery) > 0 {
-		if sortQuery == "asc" {
-			sort.Slice(chirps, func(i, j int) bool {
-				return chirps[j].Id > chirps[i].Id
-			})
-			utils.RespondWithJson(w, http.StatusOK, chirps)
-		}
-		if sortQuery == "desc" {
-			sort.Slice(chirps, func(i, j int) bool {
-				return chirps[j].Id < chirps[i].Id
-			})
-			utils.RespondWithJson(w, http.StatusOK, chirps)
-		}
+
+	less, ok := chirpSortKeys[r.URL.Query().Get("sort_by")]
+	if !ok {
+		utils.RespondWithError(w, http.StatusBadRequest, "sort_by must be one of id, created_at or updated_at")
 		return
 	}
-	if len(authorId) > 0 {
-		authorIdInt, err := strconv.Atoi(authorId)
-		if err != nil {
-			utils.RespondWithError(w, http.StatusBadRequest, "the author id is not well formatted")
-			return
-		}
-		response := []database.Chirp{}
-		for _, value := range chirps {
-			if value.AuthorId == authorIdInt {
-				response = append(response, value)
-			}
-		}
-		utils.RespondWithJson(w, http.StatusOK, response)
-		return
+	sortQuery := r.URL.Query().Get("sort")
+	if sortQuery == "desc" {
+		sort.SliceStable(chirps, func(i, j int) bool {
+			return less(chirps[j], chirps[i])
+		})
+	} else {
+		sort.SliceStable(chirps, func(i, j int) bool {
+			return less(chirps[i], chirps[j])
+		})
 	}
 
 	utils.RespondWithJson(w, http.StatusOK, chirps)
@@ -0,0 +1,13 @@
+package handlers
+
+import (
+	"chirpy/utils"
+	"net/http"
+)
+
+// handleJWKSEndpoint publishes the public keys access tokens are signed
+// with, so other services can verify them
+func (a *ApiConfig) handleJWKSEndpoint(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	utils.RespondWithJson(w, http.StatusOK, a.Tokens.Keys.JWKS())
+}
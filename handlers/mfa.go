@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"chirpy/internal/auth"
+	"chirpy/internal/database"
+	"chirpy/utils"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// respondWithMFAChallenge answers a correct password of a user with
+// two-factor authentication with the token loginWithMFA exchanges for the
+// login's tokens
+func (a *ApiConfig) respondWithMFAChallenge(w http.ResponseWriter, user database.User, scopes []string) {
+	type ResponseBody struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+		ExpiresIn   int    `json:"expires_in_seconds"`
+	}
+	token, err := a.Tokens.NewMFAToken(string(user.Id), user.PasswordStamp(), scopes)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.RespondWithJson(w, http.StatusOK, ResponseBody{
+		MFARequired: true,
+		MFAToken:    token,
+		ExpiresIn:   int(auth.MFATokenLifetime.Seconds()),
+	})
+}
+
+// loginWithMFA is the second step of logging in with two-factor
+// authentication: it exchanges the token from loginUser and a code from
+// the user's authenticator, or a recovery code, for access and refresh
+// tokens
+func (a *ApiConfig) loginWithMFA(w http.ResponseWriter, r *http.Request) {
+	type RequestBody struct {
+		MFAToken       string `json:"mfa_token"`
+		Code           string `json:"code"`
+		ExpirationTime int    `json:"expires_in_seconds"`
+	}
+	bodyJson := RequestBody{}
+	err := json.NewDecoder(r.Body).Decode(&bodyJson)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "couldn't convert body")
+		return
+	}
+	claims, err := a.Tokens.ParseMFAToken(bodyJson.MFAToken)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userId := database.ID(claims.Subject)
+	err = a.verifyMFA(userId, bodyJson.Code)
+	if err == nil {
+		err = a.Database.UseMFAChallenge(userId, claims.ID, claims.ExpiresAt.Time)
+	}
+	if err != nil {
+		respondWithMFAError(w, http.StatusUnauthorized, err)
+		return
+	}
+	login, err := a.Database.StartSession(userId, claims.PasswordStamp, device(r), claims.Scopes())
+	if errors.Is(err, database.ErrUserNotFound) || errors.Is(err, database.ErrPasswordChanged) {
+		utils.RespondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "something went wrong in the database")
+		return
+	}
+	a.respondWithLogin(w, login, bodyJson.ExpirationTime)
+}
+
+// enrollMFA starts setting up two-factor authentication with a new secret
+// for the user's authenticator. It only takes effect once confirmMFA
+// checked a code of it.
+func (a *ApiConfig) enrollMFA(w http.ResponseWriter, r *http.Request) {
+	type ResponseBody struct {
+		Secret string `json:"secret"`
+		URI    string `json:"otpauth_uri"`
+	}
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	user, err := a.Database.EnrollMFA(principal.UserId, secret)
+	if err != nil {
+		respondWithMFAError(w, http.StatusForbidden, err)
+		return
+	}
+	utils.RespondWithJson(w, http.StatusOK, ResponseBody{
+		Secret: secret,
+		URI:    auth.TOTPURI(secret, user.Email),
+	})
+}
+
+// confirmMFA enables two-factor authentication with a code of the secret
+// from enrollMFA and hands out the recovery codes, which are only shown
+// this once
+func (a *ApiConfig) confirmMFA(w http.ResponseWriter, r *http.Request) {
+	type RequestBody struct {
+		Code string `json:"code"`
+	}
+	type ResponseBody struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
+	bodyJson := RequestBody{}
+	err := json.NewDecoder(r.Body).Decode(&bodyJson)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "couldn't convert body")
+		return
+	}
+	mfa, err := a.Database.GetMFA(principal.UserId)
+	if err == nil && mfa.IsEnabled() {
+		err = database.ErrMFAEnabled
+	}
+	if err != nil {
+		respondWithMFAError(w, http.StatusBadRequest, err)
+		return
+	}
+	step, ok := auth.ValidateTOTP(mfa.Secret, auth.NormalizeCode(bodyJson.Code), time.Now())
+	if !ok {
+		respondWithMFAError(w, http.StatusBadRequest, database.ErrMFACodeInvalid)
+		return
+	}
+	codes, hashes, err := auth.NewRecoveryCodes()
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = a.Database.EnableMFA(principal.UserId, step, hashes)
+	if err != nil {
+		respondWithMFAError(w, http.StatusBadRequest, err)
+		return
+	}
+	utils.RespondWithJson(w, http.StatusOK, ResponseBody{RecoveryCodes: codes})
+}
+
+// disableMFA turns two-factor authentication off. It takes a code too, so
+// a stolen access token isn't enough to do it.
+func (a *ApiConfig) disableMFA(w http.ResponseWriter, r *http.Request) {
+	type RequestBody struct {
+		Code string `json:"code"`
+	}
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
+	bodyJson := RequestBody{}
+	err := json.NewDecoder(r.Body).Decode(&bodyJson)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "couldn't convert body")
+		return
+	}
+	err = a.verifyMFA(principal.UserId, bodyJson.Code)
+	if err == nil {
+		err = a.Database.DisableMFA(principal.UserId)
+	}
+	if err != nil {
+		respondWithMFAError(w, http.StatusForbidden, err)
+		return
+	}
+	utils.RespondWithJson(w, http.StatusNoContent, nil)
+}
+
+// verifyMFA checks a code from the user's authenticator or one of their
+// recovery codes, which is used up. Wrong codes are counted, so guessing
+// locks the user's second factor.
+func (a *ApiConfig) verifyMFA(userId database.ID, code string) error {
+	now := time.Now()
+	mfa, err := a.Database.GetMFA(userId)
+	if err != nil {
+		return err
+	}
+	if !mfa.IsEnabled() {
+		return database.ErrMFANotEnrolled
+	}
+	if mfa.IsLocked(now) {
+		return database.ErrMFALocked
+	}
+	code = auth.NormalizeCode(code)
+	if auth.IsTOTPCode(code) {
+		step, ok := auth.ValidateTOTP(mfa.Secret, code, now)
+		if ok {
+			return a.Database.UseMFAStep(userId, step)
+		}
+	} else {
+		err := a.Database.UseRecoveryCode(userId, auth.HashRecoveryCode(code))
+		if !errors.Is(err, database.ErrMFACodeInvalid) {
+			return err
+		}
+	}
+	err = a.Database.RecordMFAFailure(userId)
+	if err != nil {
+		return err
+	}
+	return database.ErrMFACodeInvalid
+}
+
+// respondWithMFAError answers a failed two-factor authentication request.
+// Wrong codes get wrongCodeStatus, which depends on whether the code was
+// all the request was authenticated with.
+func respondWithMFAError(w http.ResponseWriter, wrongCodeStatus int, err error) {
+	switch {
+	case errors.Is(err, database.ErrMFACodeInvalid),
+		errors.Is(err, database.ErrMFACodeReused),
+		errors.Is(err, database.ErrMFAChallengeUsed),
+		errors.Is(err, database.ErrUserNotFound):
+		utils.RespondWithError(w, wrongCodeStatus, err.Error())
+	case errors.Is(err, database.ErrMFALocked):
+		utils.RespondWithError(w, http.StatusTooManyRequests, err.Error())
+	case errors.Is(err, database.ErrMFAEnabled), errors.Is(err, database.ErrMFANotEnrolled):
+		utils.RespondWithError(w, http.StatusConflict, err.Error())
+	default:
+		utils.RespondWithError(w, http.StatusInternalServerError, "something went wrong in the database")
+	}
+}
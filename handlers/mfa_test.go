@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"chirpy/internal/auth"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// post sends body to handler and returns the response
+func post(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	return w
+}
+
+// startMFALogin logs in with the password and returns the MFA token the
+// login answers with
+func startMFALogin(t *testing.T, apiCfg *ApiConfig) string {
+	t.Helper()
+	w := post(apiCfg.loginUser, `{"email": "a@example.com", "password": "password"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("logging in: status %d: %s", w.Code, w.Body)
+	}
+	response := struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+	}{}
+	err := json.NewDecoder(w.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.MFARequired || len(response.MFAToken) == 0 {
+		t.Fatalf("logging in didn't ask for a code: %+v", response)
+	}
+	return response.MFAToken
+}
+
+func TestLoginWithMFA(t *testing.T) {
+	apiCfg := newTestApi(t)
+	user, _ := newTestUser(t, apiCfg)
+	_, err := apiCfg.Database.EnrollMFA(user.Id, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, hashes, err := auth.NewRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = apiCfg.Database.EnableMFA(user.Id, 1, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange := func(token string, code string) *httptest.ResponseRecorder {
+		return post(apiCfg.loginWithMFA, `{"mfa_token": "`+token+`", "code": "`+code+`"}`)
+	}
+
+	token := startMFALogin(t, apiCfg)
+	w := exchange(token, codes[0])
+	if w.Code != http.StatusOK {
+		t.Fatalf("exchanging the MFA token: status %d: %s", w.Code, w.Body)
+	}
+	w = exchange(token, codes[1])
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("exchanging the MFA token again: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	token = startMFALogin(t, apiCfg)
+	_, err = apiCfg.Database.UpdateUser(user.Id, user.Email, "new password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = exchange(token, codes[2])
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("exchanging an MFA token after the password changed: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	sessions, err := apiCfg.Database.GetSessions(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 {
+		t.Errorf("got %d sessions, want only the one of the first exchange", len(sessions))
+	}
+}
@@ -1,35 +1,147 @@
 package handlers
 
 import (
+	"chirpy/internal/auth"
+	"chirpy/internal/database"
 	"chirpy/utils"
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
-
-	"github.com/golang-jwt/jwt/v5"
+	"slices"
 )
 
 type contextKey string
 
-const userClaimsKey contextKey = "userClaims"
+const principalKey contextKey = "principal"
+
+// errUserGone is returned for valid tokens of users that were deleted
+var errUserGone = errors.New("the token's user no longer exists")
 
-// AuthMiddleware is a middleware function for JWT authentication
+// Principal is the user a request is made by, as authenticated by
+// AuthMiddleware. Roles come from the database rather than the token, so
+// revoking one takes effect at once.
+type Principal struct {
+	UserId    database.ID
+	Roles     []string
+	Scopes    []string
+	IsRedUser bool
+}
+
+// HasRole reports whether the principal was granted role
+func (p *Principal) HasRole(role string) bool {
+	return slices.Contains(p.Roles, role)
+}
+
+// HasScope reports whether the principal's token carries scope
+func (p *Principal) HasScope(scope string) bool {
+	return slices.Contains(p.Scopes, scope)
+}
+
+// AuthMiddleware authenticates requests with their access token or a
+// personal access token and puts the Principal they are made by in the
+// request context. The user is looked up on every request, so deleted
+// users are locked out right away and red status is never stale.
 func (a *ApiConfig) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		claims, err := a.parseJWT(r)
+		credentials, err := auth.Credentials(r.Header.Get("Authorization"), auth.SchemeBearer)
+		if err != nil {
+			respondWithAuthError(w, auth.SchemeBearer, err)
+			return
+		}
+		var userId database.ID
+		var scopes []string
+		if database.IsPersonalToken(credentials) {
+			token, err := a.Database.UsePersonalToken(credentials)
+			if errors.Is(err, database.ErrPersonalTokenInvalid) {
+				respondWithAuthError(w, auth.SchemeBearer, err)
+				return
+			}
+			if err != nil {
+				utils.RespondWithError(w, http.StatusInternalServerError, "something went wrong in the database")
+				return
+			}
+			userId, scopes = token.UserId, token.Scopes
+		} else {
+			claims, err := a.Tokens.ParseAccessToken(credentials)
+			if err != nil {
+				respondWithAuthError(w, auth.SchemeBearer, err)
+				return
+			}
+			userId, scopes = database.ID(claims.Subject), claims.Scopes()
+		}
+		user, err := a.Database.GetUser(userId)
+		if errors.Is(err, database.ErrUserNotFound) {
+			respondWithAuthError(w, auth.SchemeBearer, errUserGone)
+			return
+		}
 		if err != nil {
-			utils.RespondWithError(w, http.StatusUnauthorized, "the user is not authorized")
+			utils.RespondWithError(w, http.StatusInternalServerError, "something went wrong in the database")
 			return
 		}
 
-		// Store the claims in the context for later use
-		ctx := context.WithValue(r.Context(), userClaimsKey, claims)
+		// tokens only keep the admin scope while their user is an admin
+		scopes = auth.GrantedScopes(scopes, user.HasRole(database.RoleAdmin))
+		principal := &Principal{
+			UserId:    user.Id,
+			Roles:     user.Roles,
+			Scopes:    scopes,
+			IsRedUser: user.IsRedUser,
+		}
+		ctx := context.WithValue(r.Context(), principalKey, principal)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-func getUserClaims(ctx context.Context) (*jwt.RegisteredClaims, bool) {
-	claims, ok := ctx.Value(userClaimsKey).(*jwt.RegisteredClaims)
-	return claims, ok
+// RequireRole only lets principals with role through to next. It must be
+// wrapped in AuthMiddleware.
+func RequireRole(role string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := requirePrincipal(w, r)
+		if !ok {
+			return
+		}
+		if !principal.HasRole(role) {
+			utils.RespondWithError(w, http.StatusForbidden, fmt.Sprintf("this requires the %s role", role))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireScope only lets principals whose token carries scope through to
+// next. It must be wrapped in AuthMiddleware.
+func RequireScope(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := requirePrincipal(w, r)
+		if !ok {
+			return
+		}
+		if !principal.HasScope(scope) {
+			message := fmt.Sprintf("this requires the %s scope", scope)
+			w.Header().Set("WWW-Authenticate", auth.SchemeBearer+` realm="chirpy", error="insufficient_scope", scope="`+scope+`", error_description="`+message+`"`)
+			utils.RespondWithError(w, http.StatusForbidden, message)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// protected authenticates requests to handler and requires scope of them
+func (a *ApiConfig) protected(scope string, handler http.HandlerFunc) http.Handler {
+	return a.AuthMiddleware(RequireScope(scope, handler))
+}
+
+// requirePrincipal returns the Principal AuthMiddleware stored for the
+// request. A handler that wasn't wrapped in it rejects the request rather
+// than serve it anonymously.
+func requirePrincipal(w http.ResponseWriter, r *http.Request) (*Principal, bool) {
+	principal, ok := r.Context().Value(principalKey).(*Principal)
+	if !ok {
+		respondWithAuthError(w, auth.SchemeBearer, auth.ErrTokenMissing)
+		return nil, false
+	}
+	return principal, true
 }
 
 func (a *ApiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
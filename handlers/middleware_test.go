@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"chirpy/internal/auth"
+	"chirpy/internal/database"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestApi returns an ApiConfig backed by an in-memory database that signs
+// access tokens with a test secret
+func newTestApi(t *testing.T) *ApiConfig {
+	t.Helper()
+	keys, err := auth.SecretKeyring("test secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ApiConfig{
+		Database: database.NewMemoryDB(),
+		Tokens:   &auth.Tokens{Keys: keys, Audience: auth.Issuer},
+	}
+}
+
+// newTestUser creates a user and returns an access token for it limited to
+// scopes
+func newTestUser(t *testing.T, apiCfg *ApiConfig, scopes ...string) (database.User, string) {
+	t.Helper()
+	user, err := apiCfg.Database.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := apiCfg.Tokens.NewAccessToken(string(user.Id), user.Roles, scopes, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, token
+}
+
+func TestProtectedRequiresScope(t *testing.T) {
+	tests := []struct {
+		name      string
+		scopes    []string
+		status    int
+		challenge string
+	}{
+		{"no scope", nil, http.StatusForbidden, `error="insufficient_scope", scope="chirps:write"`},
+		{"other scope", []string{auth.ScopeChirpsRead}, http.StatusForbidden, `error="insufficient_scope", scope="chirps:write"`},
+		{"required scope", []string{auth.ScopeChirpsWrite}, http.StatusNoContent, ""},
+		{"several scopes", []string{auth.ScopeChirpsRead, auth.ScopeChirpsWrite}, http.StatusNoContent, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apiCfg := newTestApi(t)
+			user, token := newTestUser(t, apiCfg, tt.scopes...)
+			handler := apiCfg.protected(auth.ScopeChirpsWrite, func(w http.ResponseWriter, r *http.Request) {
+				principal, ok := requirePrincipal(w, r)
+				if !ok {
+					return
+				}
+				if principal.UserId != user.Id {
+					t.Errorf("principal is user %s, want %s", principal.UserId, user.Id)
+				}
+				w.WriteHeader(http.StatusNoContent)
+			})
+
+			r := httptest.NewRequest(http.MethodPost, "/api/chirps", nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			challenge := w.Header().Get("WWW-Authenticate")
+			if !strings.Contains(challenge, tt.challenge) {
+				t.Errorf("WWW-Authenticate %q, want it to contain %q", challenge, tt.challenge)
+			}
+		})
+	}
+}
+
+func TestProtectedRejectsMissingToken(t *testing.T) {
+	apiCfg := newTestApi(t)
+	handler := apiCfg.protected(auth.ScopeChirpsWrite, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the handler was called without a token")
+	})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/chirps", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if challenge := w.Header().Get("WWW-Authenticate"); !strings.HasPrefix(challenge, auth.SchemeBearer) {
+		t.Errorf("WWW-Authenticate %q, want a Bearer challenge", challenge)
+	}
+}
+
+func TestAuthMiddlewareAcceptsPersonalTokens(t *testing.T) {
+	apiCfg := newTestApi(t)
+	user, _ := newTestUser(t, apiCfg)
+	_, secret, err := apiCfg.Database.CreatePersonalToken(user.Id, "script", []string{auth.ScopeChirpsRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var principal *Principal
+	handler := apiCfg.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ = requirePrincipal(w, r)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"personal token", "Bearer " + secret, http.StatusNoContent},
+		{"unknown personal token", "Bearer " + database.PersonalTokenPrefix + "unknown", http.StatusUnauthorized},
+		{"wrong scheme", "ApiKey " + secret, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal = nil
+			r := httptest.NewRequest(http.MethodGet, "/api/tokens", nil)
+			r.Header.Set("Authorization", tt.header)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusNoContent {
+				if principal != nil {
+					t.Error("the request was let through")
+				}
+				return
+			}
+			if principal == nil || principal.UserId != user.Id {
+				t.Fatalf("the request was made by %+v, want user %s", principal, user.Id)
+			}
+			if !principal.HasScope(auth.ScopeChirpsRead) || principal.HasScope(auth.ScopeChirpsWrite) {
+				t.Errorf("the principal has scopes %v, want only the token's", principal.Scopes)
+			}
+		})
+	}
+
+	tokens, err := apiCfg.Database.GetPersonalTokens(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].LastUsedAt == nil {
+		t.Errorf("got tokens %+v, want one that records it was used", tokens)
+	}
+}
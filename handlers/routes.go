@@ -1,33 +1,58 @@
 package handlers
 
 import (
+	"chirpy/internal/auth"
 	"chirpy/internal/database"
 	"net/http"
 )
 
 type ApiConfig struct {
-	Database       *database.DB
-	JwtSecret      string
+	Database       database.Store
+	Tokens         *auth.Tokens
+	BackupDir      string
 	FileserverHits int
 }
 
+// requireAdmin lets only admins through to handler
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return RequireRole(database.RoleAdmin, handler).ServeHTTP
+}
+
+// RegisterRoutes serves the API on mux. Routes that act for a user declare
+// the scope their access token needs; reading chirps is public.
 func RegisterRoutes(mux *http.ServeMux, apiCfg *ApiConfig) {
 	mux.Handle("/app/*", apiCfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(".")))))
-	mux.HandleFunc("/admin/metrics", apiCfg.handleMetricsEndpoint)
-	mux.HandleFunc("/api/reset", apiCfg.handleResetEndpoint)
+	mux.Handle("/admin/metrics", apiCfg.protected(auth.ScopeAdmin, requireAdmin(apiCfg.handleMetricsEndpoint)))
+	mux.Handle("POST /admin/snapshot", apiCfg.protected(auth.ScopeAdmin, requireAdmin(apiCfg.handleSnapshotEndpoint)))
+	mux.Handle("/api/reset", apiCfg.protected(auth.ScopeAdmin, requireAdmin(apiCfg.handleResetEndpoint)))
 	mux.HandleFunc("/api/healthz", handleReadinessEndpoint)
+	mux.HandleFunc("GET /.well-known/jwks.json", apiCfg.handleJWKSEndpoint)
 
 	mux.HandleFunc("GET /api/chirps", apiCfg.fetchChirps)
 	mux.HandleFunc("GET /api/chirps/{chirpId}", apiCfg.fetchSingleChirp)
-	mux.HandleFunc("POST /api/chirps", apiCfg.createChirps)
-	mux.HandleFunc("DELETE /api/chirps/{chirpId}", apiCfg.deleteSingleChirp)
+	mux.Handle("POST /api/chirps", apiCfg.protected(auth.ScopeChirpsWrite, apiCfg.createChirps))
+	mux.Handle("DELETE /api/chirps/{chirpId}", apiCfg.protected(auth.ScopeChirpsWrite, apiCfg.deleteSingleChirp))
+	mux.Handle("POST /api/chirps/{chirpId}/restore", apiCfg.protected(auth.ScopeChirpsWrite, apiCfg.restoreSingleChirp))
 
 	mux.HandleFunc("POST /api/users", apiCfg.createUsers)
-	mux.HandleFunc("PUT /api/users", apiCfg.updateUser)
+	mux.Handle("PUT /api/users", apiCfg.protected(auth.ScopeAccountWrite, apiCfg.updateUser))
 	mux.HandleFunc("POST /api/login", apiCfg.loginUser)
+	mux.HandleFunc("POST /api/login/mfa", apiCfg.loginWithMFA)
+
+	mux.Handle("POST /api/mfa/totp", apiCfg.protected(auth.ScopeAccountWrite, apiCfg.enrollMFA))
+	mux.Handle("POST /api/mfa/totp/confirm", apiCfg.protected(auth.ScopeAccountWrite, apiCfg.confirmMFA))
+	mux.Handle("DELETE /api/mfa/totp", apiCfg.protected(auth.ScopeAccountWrite, apiCfg.disableMFA))
 
 	mux.HandleFunc("POST /api/refresh", apiCfg.generateAccessToken)
 	mux.HandleFunc("POST /api/revoke", apiCfg.revokeUser)
 
+	mux.Handle("GET /api/sessions", apiCfg.protected(auth.ScopeAccountRead, apiCfg.fetchSessions))
+	mux.Handle("DELETE /api/sessions", apiCfg.protected(auth.ScopeAccountWrite, apiCfg.deleteAllSessions))
+	mux.Handle("DELETE /api/sessions/{sessionId}", apiCfg.protected(auth.ScopeAccountWrite, apiCfg.deleteSingleSession))
+
+	mux.Handle("GET /api/tokens", apiCfg.protected(auth.ScopeAccountRead, apiCfg.fetchPersonalTokens))
+	mux.Handle("POST /api/tokens", apiCfg.protected(auth.ScopeAccountWrite, apiCfg.createPersonalToken))
+	mux.Handle("DELETE /api/tokens/{tokenId}", apiCfg.protected(auth.ScopeAccountWrite, apiCfg.deletePersonalToken))
+
 	mux.HandleFunc("POST /api/polka/webhooks", apiCfg.polkaUpgradeHandler)
 }
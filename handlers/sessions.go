@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"chirpy/internal/database"
+	"chirpy/utils"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+type sessionResponse struct {
+	CreatedAt  time.Time   `json:"created_at"`
+	LastUsedAt time.Time   `json:"last_used_at"`
+	ExpiresAt  time.Time   `json:"expires_at"`
+	UserAgent  string      `json:"user_agent"`
+	IP         string      `json:"ip"`
+	Id         database.ID `json:"id"`
+}
+
+// fetchSessions lists the devices the user is logged in on
+func (a *ApiConfig) fetchSessions(w http.ResponseWriter, r *http.Request) {
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
+	sessions, err := a.Database.GetSessions(principal.UserId)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "something went wrong in the database")
+		return
+	}
+
+	response := []sessionResponse{}
+	for _, session := range sessions {
+		response = append(response, sessionResponse{
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			ExpiresAt:  session.ExpiresAt,
+			UserAgent:  session.UserAgent,
+			IP:         session.IP,
+			Id:         session.Id,
+		})
+	}
+	utils.RespondWithJson(w, http.StatusOK, response)
+}
+
+// deleteSingleSession logs the user out on one device
+func (a *ApiConfig) deleteSingleSession(w http.ResponseWriter, r *http.Request) {
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
+	err := a.Database.DeleteSession(database.ID(r.PathValue("sessionId")), principal.UserId)
+	if errors.Is(err, database.ErrSessionNotFound) {
+		utils.RespondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "something went wrong in the database")
+		return
+	}
+	utils.RespondWithJson(w, http.StatusNoContent, nil)
+}
+
+// deleteAllSessions logs the user out everywhere. Access tokens that were
+// already handed out stay valid until they expire.
+func (a *ApiConfig) deleteAllSessions(w http.ResponseWriter, r *http.Request) {
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
+	_, err := a.Database.DeleteSessions(principal.UserId)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "something went wrong in the database")
+		return
+	}
+	utils.RespondWithJson(w, http.StatusNoContent, nil)
+}
+
+// device describes the client a request came from, for its session
+func device(r *http.Request) database.Device {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return database.Device{
+		UserAgent: r.UserAgent(),
+		IP:        ip,
+	}
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"chirpy/internal/database"
+	"chirpy/utils"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// keepSnapshots is how many snapshots are kept in the backup directory;
+// taking another one removes the oldest
+const keepSnapshots = 20
+
+// snapshotPattern matches the names snapshots are taken under, which sort
+// by the time they were taken
+const snapshotPattern = "database-*.json"
+
+func (a *ApiConfig) handleSnapshotEndpoint(w http.ResponseWriter, _ *http.Request) {
+	type ResponseBody struct {
+		Path string `json:"path"`
+	}
+	snapshotter, ok := a.Database.(database.Snapshotter)
+	if !ok {
+		utils.RespondWithError(w, http.StatusNotImplemented, "this database backend doesn't support snapshots")
+		return
+	}
+	err := os.MkdirAll(a.BackupDir, 0700)
+	if err != nil {
+		log.Printf("Error creating the backup directory: %s", err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "couldn't take the snapshot")
+		return
+	}
+	path := filepath.Join(a.BackupDir, strings.Replace(snapshotPattern, "*", time.Now().UTC().Format("20060102T150405.000Z"), 1))
+	err = snapshotter.Snapshot(path)
+	if err != nil {
+		log.Printf("Error taking a snapshot: %s", err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "couldn't take the snapshot")
+		return
+	}
+	err = pruneSnapshots(a.BackupDir)
+	if err != nil {
+		// the snapshot was taken, the old ones are removed next time
+		log.Printf("Error removing old snapshots: %s", err)
+	}
+	utils.RespondWithJson(w, http.StatusCreated, ResponseBody{Path: path})
+}
+
+// pruneSnapshots removes all but the newest keepSnapshots snapshots in dir
+func pruneSnapshots(dir string) error {
+	snapshots, err := filepath.Glob(filepath.Join(dir, snapshotPattern))
+	if err != nil {
+		return err
+	}
+	sort.Strings(snapshots)
+	for len(snapshots) > keepSnapshots {
+		err := os.Remove(snapshots[0])
+		if err != nil {
+			return err
+		}
+		snapshots = snapshots[1:]
+	}
+	return nil
+}
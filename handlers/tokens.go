@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"chirpy/internal/auth"
+	"chirpy/internal/database"
+	"chirpy/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxPersonalTokenNameLength is how long the name of a personal access
+// token may be
+const maxPersonalTokenNameLength = 100
+
+type personalTokenResponse struct {
+	CreatedAt  time.Time   `json:"created_at"`
+	LastUsedAt *time.Time  `json:"last_used_at"`
+	Name       string      `json:"name"`
+	Scope      string      `json:"scope"`
+	Id         database.ID `json:"id"`
+	// Token is only sent once, when the token is created
+	Token string `json:"token,omitempty"`
+}
+
+func newPersonalTokenResponse(token database.PersonalToken) personalTokenResponse {
+	return personalTokenResponse{
+		CreatedAt:  token.CreatedAt,
+		LastUsedAt: token.LastUsedAt,
+		Name:       token.Name,
+		Scope:      strings.Join(token.Scopes, " "),
+		Id:         token.Id,
+	}
+}
+
+// createPersonalToken mints a personal access token for scripts and bots.
+// It gets the requested scopes the request's own credentials have, so a
+// token can't be used to mint a more powerful one.
+func (a *ApiConfig) createPersonalToken(w http.ResponseWriter, r *http.Request) {
+	type RequestBody struct {
+		Name string `json:"name"`
+		// Scope limits what the token can be used for, see auth.ParseScope
+		Scope string `json:"scope"`
+	}
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
+	bodyJson := RequestBody{}
+	err := json.NewDecoder(r.Body).Decode(&bodyJson)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "couldn't convert body")
+		return
+	}
+	name := strings.TrimSpace(bodyJson.Name)
+	if len(name) == 0 || len(name) > maxPersonalTokenNameLength {
+		utils.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("the token needs a name of at most %d characters", maxPersonalTokenNameLength))
+		return
+	}
+	scopes, err := auth.ParseScope(bodyJson.Scope)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	scopes = slices.DeleteFunc(scopes, func(scope string) bool {
+		return !principal.HasScope(scope)
+	})
+
+	token, secret, err := a.Database.CreatePersonalToken(principal.UserId, name, scopes)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "something went wrong in the database")
+		return
+	}
+	response := newPersonalTokenResponse(token)
+	response.Token = secret
+	utils.RespondWithJson(w, http.StatusCreated, response)
+}
+
+// fetchPersonalTokens lists the user's personal access tokens, without the
+// tokens themselves
+func (a *ApiConfig) fetchPersonalTokens(w http.ResponseWriter, r *http.Request) {
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
+	tokens, err := a.Database.GetPersonalTokens(principal.UserId)
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "something went wrong in the database")
+		return
+	}
+
+	response := []personalTokenResponse{}
+	for _, token := range tokens {
+		response = append(response, newPersonalTokenResponse(token))
+	}
+	utils.RespondWithJson(w, http.StatusOK, response)
+}
+
+// deletePersonalToken revokes one of the user's personal access tokens
+func (a *ApiConfig) deletePersonalToken(w http.ResponseWriter, r *http.Request) {
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
+	err := a.Database.DeletePersonalToken(database.ID(r.PathValue("tokenId")), principal.UserId)
+	if errors.Is(err, database.ErrPersonalTokenNotFound) {
+		utils.RespondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "something went wrong in the database")
+		return
+	}
+	utils.RespondWithJson(w, http.StatusNoContent, nil)
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"chirpy/internal/auth"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCreatePersonalTokenLimitsScopes(t *testing.T) {
+	tests := []struct {
+		name      string
+		scopes    []string
+		requested string
+		want      string
+	}{
+		{"requested scopes", []string{auth.ScopeAccountWrite, auth.ScopeChirpsRead, auth.ScopeChirpsWrite}, "chirps:write", "chirps:write"},
+		{"scopes the credentials lack", []string{auth.ScopeAccountWrite, auth.ScopeChirpsRead}, "chirps:read chirps:write", "chirps:read"},
+		{"admin without the admin scope", []string{auth.ScopeAccountWrite}, "admin", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apiCfg := newTestApi(t)
+			user, token := newTestUser(t, apiCfg, tt.scopes...)
+			handler := apiCfg.protected(auth.ScopeAccountWrite, apiCfg.createPersonalToken)
+
+			body := strings.NewReader(`{"name": "script", "scope": "` + tt.requested + `"}`)
+			r := httptest.NewRequest(http.MethodPost, "/api/tokens", body)
+			r.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("status %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+			}
+			response := personalTokenResponse{}
+			err := json.NewDecoder(w.Body).Decode(&response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.Scope != tt.want {
+				t.Errorf("the token got scope %q, want %q", response.Scope, tt.want)
+			}
+
+			used, err := apiCfg.Database.UsePersonalToken(response.Token)
+			if err != nil {
+				t.Fatalf("the returned token wasn't accepted: %v", err)
+			}
+			if used.UserId != user.Id || strings.Join(used.Scopes, " ") != tt.want {
+				t.Errorf("the stored token is %+v, want one of user %s with scope %q", used, user.Id, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreatePersonalTokenNeedsName(t *testing.T) {
+	apiCfg := newTestApi(t)
+	_, token := newTestUser(t, apiCfg, auth.ScopeAccountWrite)
+	handler := apiCfg.protected(auth.ScopeAccountWrite, apiCfg.createPersonalToken)
+	for _, name := range []string{"", "   ", strings.Repeat("a", maxPersonalTokenNameLength+1)} {
+		r := httptest.NewRequest(http.MethodPost, "/api/tokens", strings.NewReader(`{"name": "`+name+`"}`))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("name %q: status %d, want %d", name, w.Code, http.StatusBadRequest)
+		}
+	}
+}
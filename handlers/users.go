@@ -1,48 +1,47 @@
 package handlers
 
 import (
+	"chirpy/internal/auth"
+	"chirpy/internal/database"
 	"chirpy/utils"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"net/http"
+	"strings"
 	"time"
-
-	"github.com/golang-jwt/jwt/v5"
 )
 
 func (a *ApiConfig) updateUser(w http.ResponseWriter, r *http.Request) {
 	type ResponseBody struct {
-		Email        string `json:"email"`
-		Id           int    `json:"id"`
-		IsChirpyUser bool   `json:"is_chirpy_red"`
+		CreatedAt    time.Time   `json:"created_at"`
+		UpdatedAt    time.Time   `json:"updated_at"`
+		Email        string      `json:"email"`
+		Id           database.ID `json:"id"`
+		IsChirpyUser bool        `json:"is_chirpy_red"`
 	}
 	type RequestBody struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
 	}
+	principal, ok := requirePrincipal(w, r)
+	if !ok {
+		return
+	}
 	bodyJson := RequestBody{}
 	err := json.NewDecoder(r.Body).Decode(&bodyJson)
 	if err != nil {
 		utils.RespondWithError(w, http.StatusBadRequest, "couldn't convert body")
 		return
 	}
-	claims, err := a.parseJWT(r)
-	if err != nil {
-		utils.RespondWithError(w, http.StatusUnauthorized, "the user is not authorized")
-		return
-	}
-	id, err := claims.GetSubject()
-	if err != nil {
-		utils.RespondWithError(w, http.StatusBadRequest, "the token is malformed")
-		return
-	}
-	user, err := a.Database.UpdateUser(id, bodyJson.Email, bodyJson.Password)
+	user, err := a.Database.UpdateUser(principal.UserId, bodyJson.Email, bodyJson.Password)
 	if err != nil {
 		utils.RespondWithError(w, http.StatusUnauthorized, "we couldn't update the user")
 		return
 	}
 
 	response := ResponseBody{
+		CreatedAt:    user.CreatedAt,
+		UpdatedAt:    user.UpdatedAt,
 		Email:        user.Email,
 		Id:           user.Id,
 		IsChirpyUser: user.IsRedUser,
@@ -55,13 +54,8 @@ func (a *ApiConfig) loginUser(w http.ResponseWriter, r *http.Request) {
 		Email          string `json:"email"`
 		Password       string `json:"password"`
 		ExpirationTime int    `json:"expires_in_seconds"`
-	}
-	type ResponseBody struct {
-		Email        string `json:"email"`
-		Token        string `json:"token"`
-		RefreshToken string `json:"refresh_token"`
-		Id           int    `json:"id"`
-		IsRedUser    bool   `json:"is_chirpy_red"`
+		// Scope limits what the tokens can be used for, see auth.ParseScope
+		Scope string `json:"scope"`
 	}
 	bodyJson := RequestBody{}
 	err := json.NewDecoder(r.Body).Decode(&bodyJson)
@@ -69,31 +63,54 @@ func (a *ApiConfig) loginUser(w http.ResponseWriter, r *http.Request) {
 		utils.RespondWithError(w, http.StatusBadRequest, "couldn't convert body")
 		return
 	}
-	user, err := a.Database.LoginUser(bodyJson.Email, bodyJson.Password)
+	scopes, err := auth.ParseScope(bodyJson.Scope)
 	if err != nil {
-		utils.RespondWithError(w, http.StatusUnauthorized, err.Error())
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	if bodyJson.ExpirationTime == 0 {
-		bodyJson.ExpirationTime = 24 * 60 * 60
+	login, err := a.Database.LoginUser(bodyJson.Email, bodyJson.Password, device(r), scopes)
+	if errors.Is(err, database.ErrMFARequired) {
+		a.respondWithMFAChallenge(w, login.User, scopes)
+		return
+	}
+	if err != nil {
+		utils.RespondWithError(w, http.StatusUnauthorized, err.Error())
+		return
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    "chirpy",
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Duration(time.Duration(bodyJson.ExpirationTime) * time.Second))),
-		Subject:   fmt.Sprint(user.Id),
-	})
-	tokenString, err := token.SignedString([]byte(a.JwtSecret))
+	a.respondWithLogin(w, login, bodyJson.ExpirationTime)
+}
+
+// respondWithLogin hands out the tokens of a login that started a session.
+// Access tokens last expiresInSeconds, or a day if that is 0.
+func (a *ApiConfig) respondWithLogin(w http.ResponseWriter, login database.Login, expiresInSeconds int) {
+	type ResponseBody struct {
+		CreatedAt    time.Time   `json:"created_at"`
+		UpdatedAt    time.Time   `json:"updated_at"`
+		Email        string      `json:"email"`
+		Token        string      `json:"token"`
+		RefreshToken string      `json:"refresh_token"`
+		Scope        string      `json:"scope"`
+		Id           database.ID `json:"id"`
+		IsRedUser    bool        `json:"is_chirpy_red"`
+	}
+	if expiresInSeconds == 0 {
+		expiresInSeconds = 24 * 60 * 60
+	}
+	tokenString, granted, err := a.accessToken(login, time.Duration(expiresInSeconds)*time.Second)
 	if err != nil {
 		utils.RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	user := login.User
 	response := ResponseBody{
+		CreatedAt:    user.CreatedAt,
+		UpdatedAt:    user.UpdatedAt,
 		Email:        user.Email,
 		Id:           user.Id,
 		Token:        tokenString,
-		RefreshToken: user.RefreshToken,
+		RefreshToken: login.RefreshToken,
+		Scope:        strings.Join(granted, " "),
 		IsRedUser:    user.IsRedUser,
 	}
 	utils.RespondWithJson(w, http.StatusOK, response)
@@ -106,9 +123,11 @@ func (a *ApiConfig) createUsers(w http.ResponseWriter, r *http.Request) {
 	}
 
 	type ResponseBody struct {
-		Email        string `json:"email"`
-		Id           int    `json:"id"`
-		IsChirpyUser bool   `json:"is_chirpy_red"`
+		CreatedAt    time.Time   `json:"created_at"`
+		UpdatedAt    time.Time   `json:"updated_at"`
+		Email        string      `json:"email"`
+		Id           database.ID `json:"id"`
+		IsChirpyUser bool        `json:"is_chirpy_red"`
 	}
 
 	bodyJson := RequestBody{}
@@ -120,6 +139,8 @@ func (a *ApiConfig) createUsers(w http.ResponseWriter, r *http.Request) {
 
 	user, err := a.Database.CreateUser(bodyJson.Email, bodyJson.Password)
 	response := ResponseBody{
+		CreatedAt:    user.CreatedAt,
+		UpdatedAt:    user.UpdatedAt,
 		Email:        user.Email,
 		Id:           user.Id,
 		IsChirpyUser: user.IsRedUser,
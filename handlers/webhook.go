@@ -1,31 +1,36 @@
 package handlers
 
 import (
+	"chirpy/internal/auth"
+	"chirpy/internal/database"
 	"chirpy/utils"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"os"
 	"strings"
 )
 
+var errInvalidApiKey = errors.New("the API key is not valid")
+
 func (a *ApiConfig) polkaUpgradeHandler(w http.ResponseWriter, r *http.Request) {
 	type RequestBody struct {
 		Event string `json:"event"`
 		Data  struct {
-			UserID int `json:"user_id"`
+			UserID database.ID `json:"user_id"`
 		} `json:"data"`
 	}
 	bodyJson := RequestBody{}
-	if len(r.Header.Get("Authorization")) == 0 {
-		utils.RespondWithError(w, http.StatusUnauthorized, "You aren't authorized")
+	apiToken, err := auth.Credentials(r.Header.Get("Authorization"), auth.SchemeApiKey)
+	if err != nil {
+		respondWithAuthError(w, auth.SchemeApiKey, err)
 		return
 	}
-	apiToken := strings.Split(r.Header.Get("Authorization"), " ")[1]
 	if !strings.EqualFold(apiToken, os.Getenv("POLKA_API_KEY")) {
-		utils.RespondWithError(w, http.StatusUnauthorized, "You aren't authorized")
+		respondWithAuthError(w, auth.SchemeApiKey, errInvalidApiKey)
 		return
 	}
-	err := json.NewDecoder(r.Body).Decode(&bodyJson)
+	err = json.NewDecoder(r.Body).Decode(&bodyJson)
 	if err != nil {
 		utils.RespondWithError(w, http.StatusBadRequest, "couldn't convert body")
 		return
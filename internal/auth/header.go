@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+)
+
+// The authorization schemes Chirpy accepts
+const (
+	// SchemeBearer carries access and refresh tokens (RFC 6750)
+	SchemeBearer = "Bearer"
+	// SchemeApiKey carries the key Polka's webhooks are sent with
+	SchemeApiKey = "ApiKey"
+)
+
+var (
+	// ErrWrongScheme is returned for Authorization headers of another
+	// scheme than the one expected
+	ErrWrongScheme = errors.New("the request uses the wrong authorization scheme")
+	// ErrHeaderMalformed is returned for Authorization headers that aren't
+	// a scheme followed by credentials
+	ErrHeaderMalformed = errors.New("the Authorization header is malformed")
+)
+
+// Credentials returns the credentials of an Authorization header of the
+// form "<scheme> <credentials>". Schemes are compared case-insensitively
+// (RFC 9110). A missing header gives ErrTokenMissing.
+func Credentials(header string, scheme string) (string, error) {
+	header = strings.TrimSpace(header)
+	if len(header) == 0 {
+		return "", ErrTokenMissing
+	}
+	given, credentials, found := strings.Cut(header, " ")
+	if !strings.EqualFold(given, scheme) {
+		return "", ErrWrongScheme
+	}
+	credentials = strings.TrimSpace(credentials)
+	if !found || len(credentials) == 0 || strings.ContainsAny(credentials, " \t") {
+		return "", ErrHeaderMalformed
+	}
+	return credentials, nil
+}
@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCredentials(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      string
+		scheme      string
+		credentials string
+		err         error
+	}{
+		{"bearer token", "Bearer abc.def.ghi", SchemeBearer, "abc.def.ghi", nil},
+		{"api key", "ApiKey f271c81ff7084ee5b99a5091b42d486e", SchemeApiKey, "f271c81ff7084ee5b99a5091b42d486e", nil},
+		{"missing header", "", SchemeBearer, "", ErrTokenMissing},
+		{"only spaces", "   ", SchemeBearer, "", ErrTokenMissing},
+		{"wrong scheme", "Basic dXNlcjpwYXNz", SchemeBearer, "", ErrWrongScheme},
+		{"api key for bearer", "ApiKey abc", SchemeBearer, "", ErrWrongScheme},
+		{"no scheme", "abc.def.ghi", SchemeBearer, "", ErrWrongScheme},
+		{"lowercase scheme", "bearer abc", SchemeBearer, "abc", nil},
+		{"uppercase scheme", "BEARER abc", SchemeBearer, "abc", nil},
+		{"spaces around the header", "  Bearer abc  ", SchemeBearer, "abc", nil},
+		{"spaces between scheme and token", "Bearer    abc", SchemeBearer, "abc", nil},
+		{"scheme without credentials", "Bearer", SchemeBearer, "", ErrHeaderMalformed},
+		{"empty credentials", "Bearer    ", SchemeBearer, "", ErrHeaderMalformed},
+		{"two tokens", "Bearer abc def", SchemeBearer, "", ErrHeaderMalformed},
+		{"two tokens separated by a tab", "Bearer abc\tdef", SchemeBearer, "", ErrHeaderMalformed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			credentials, err := Credentials(test.header, test.scheme)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if credentials != test.credentials {
+				t.Errorf("got credentials %q, want %q", credentials, test.credentials)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package auth
+
+import (
+	"chirpy/internal/keyid"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	// ErrUnknownKey is returned for tokens signed with a key that isn't in
+	// the keyring
+	ErrUnknownKey = errors.New("the token was signed with an unknown key")
+	// ErrKeyRetired is returned for tokens signed with a key that was
+	// retired, which is how tokens signed with a leaked key are revoked
+	ErrKeyRetired = errors.New("the token was signed with a retired key")
+	// ErrWrongAlgorithm is returned for tokens whose algorithm isn't the
+	// one of the key they name
+	ErrWrongAlgorithm = errors.New("the token's algorithm doesn't match its key")
+)
+
+// minRSABits is the smallest RSA key accepted for signing or verifying
+const minRSABits = 2048
+
+// SigningKey is a key tokens are signed and verified with
+type SigningKey struct {
+	Id     string
+	Method jwt.SigningMethod
+	// private signs tokens; keys that only verify don't have one
+	private any
+	public  any
+}
+
+// Keyring holds the keys tokens are signed with. The first key signs new
+// tokens; the others only verify tokens signed before a key rotation, until
+// those have expired. Retired keys verify nothing.
+type Keyring struct {
+	current *SigningKey
+	keys    []*SigningKey
+	byId    map[string]*SigningKey
+	retired map[string]bool
+}
+
+// NewKeyring builds a keyring from keys, the one that signs first.
+// retired lists the ids of keys whose tokens must be rejected.
+func NewKeyring(keys []*SigningKey, retired ...string) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("a keyring needs at least one key")
+	}
+	if keys[0].private == nil {
+		return nil, fmt.Errorf("key %q can't sign tokens, it has no private key", keys[0].Id)
+	}
+	keyring := &Keyring{
+		current: keys[0],
+		keys:    keys,
+		byId:    map[string]*SigningKey{},
+		retired: map[string]bool{},
+	}
+	for _, key := range keys {
+		if _, exists := keyring.byId[key.Id]; exists {
+			return nil, fmt.Errorf("there are two keys with id %q", key.Id)
+		}
+		keyring.byId[key.Id] = key
+	}
+	for _, id := range retired {
+		if _, exists := keyring.byId[id]; exists {
+			return nil, fmt.Errorf("key %q is both active and retired", id)
+		}
+		keyring.retired[id] = true
+	}
+	return keyring, nil
+}
+
+// SecretKeyring is a keyring of a single HS256 secret, for deployments
+// that don't have a keys file
+func SecretKeyring(secret string) (*Keyring, error) {
+	key, err := NewHMACKey(keyid.Derive([]byte(secret)), []byte(secret))
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyring([]*SigningKey{key})
+}
+
+// NewHMACKey returns an HS256 key, which both signs and verifies
+func NewHMACKey(id string, secret []byte) (*SigningKey, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("key %q: the secret is empty", id)
+	}
+	return &SigningKey{Id: id, Method: jwt.SigningMethodHS256, private: secret, public: secret}, nil
+}
+
+// ParsePrivateKey reads a PEM encoded RS256 or EdDSA private key
+func ParsePrivateKey(id string, alg string, data []byte) (*SigningKey, error) {
+	switch alg {
+	case "RS256":
+		private, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		if private.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("key %q: RSA keys must have at least %d bits", id, minRSABits)
+		}
+		return &SigningKey{Id: id, Method: jwt.SigningMethodRS256, private: private, public: &private.PublicKey}, nil
+	case "EdDSA":
+		parsed, err := jwt.ParseEdPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		private, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("key %q is not an Ed25519 key", id)
+		}
+		return &SigningKey{Id: id, Method: jwt.SigningMethodEdDSA, private: private, public: private.Public()}, nil
+	default:
+		return nil, fmt.Errorf("key %q: unsupported algorithm %q", id, alg)
+	}
+}
+
+// ParsePublicKey reads a PEM encoded RS256 or EdDSA public key, which only
+// verifies tokens
+func ParsePublicKey(id string, alg string, data []byte) (*SigningKey, error) {
+	switch alg {
+	case "RS256":
+		public, err := jwt.ParseRSAPublicKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		if public.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("key %q: RSA keys must have at least %d bits", id, minRSABits)
+		}
+		return &SigningKey{Id: id, Method: jwt.SigningMethodRS256, public: public}, nil
+	case "EdDSA":
+		parsed, err := jwt.ParseEdPublicKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		public, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("key %q is not an Ed25519 key", id)
+		}
+		return &SigningKey{Id: id, Method: jwt.SigningMethodEdDSA, public: public}, nil
+	default:
+		return nil, fmt.Errorf("key %q: unsupported algorithm %q", id, alg)
+	}
+}
+
+// keysFile is the format of the file LoadKeyring reads. Key files are
+// relative to the directory of the keys file. An HS256 secret without a
+// kid gets the id JWT_SECRET_KEY would have, so tokens signed before
+// moving to a keys file stay valid.
+//
+//	{"keys": [
+//	  {"kid": "2024-06", "alg": "EdDSA", "private_key_file": "ed25519.pem"},
+//	  {"kid": "2024-01", "alg": "RS256", "public_key_file": "rsa.pub.pem"},
+//	  {"alg": "HS256", "secret": "..."},
+//	  {"kid": "2023-01", "alg": "HS256", "retired": true}
+//	]}
+type keysFile struct {
+	Keys []struct {
+		Id             string `json:"kid"`
+		Alg            string `json:"alg"`
+		Secret         string `json:"secret"`
+		PrivateKeyFile string `json:"private_key_file"`
+		PublicKeyFile  string `json:"public_key_file"`
+		Retired        bool   `json:"retired"`
+	} `json:"keys"`
+}
+
+// LoadKeyring reads a keyring from a keys file. The first key that isn't
+// retired signs new tokens.
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := keysFile{}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	dir := filepath.Dir(path)
+	readPEM := func(name string) ([]byte, error) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		return os.ReadFile(name)
+	}
+	keys := []*SigningKey{}
+	retired := []string{}
+	for i, entry := range file.Keys {
+		if len(entry.Id) == 0 && entry.Alg == "HS256" && len(entry.Secret) > 0 {
+			entry.Id = keyid.Derive([]byte(entry.Secret))
+		}
+		if len(entry.Id) == 0 {
+			return nil, fmt.Errorf("%s: key %d has no kid", path, i+1)
+		}
+		if entry.Retired {
+			retired = append(retired, entry.Id)
+			continue
+		}
+		var key *SigningKey
+		switch {
+		case entry.Alg == "HS256":
+			key, err = NewHMACKey(entry.Id, []byte(entry.Secret))
+		case len(entry.PrivateKeyFile) > 0:
+			data, err = readPEM(entry.PrivateKeyFile)
+			if err == nil {
+				key, err = ParsePrivateKey(entry.Id, entry.Alg, data)
+			}
+		case len(entry.PublicKeyFile) > 0:
+			data, err = readPEM(entry.PublicKeyFile)
+			if err == nil {
+				key, err = ParsePublicKey(entry.Id, entry.Alg, data)
+			}
+		default:
+			err = fmt.Errorf("key %q has neither a private_key_file nor a public_key_file", entry.Id)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+	keyring, err := NewKeyring(keys, retired...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return keyring, nil
+}
+
+// Sign returns a token for claims signed with the current key, which it
+// names in the kid header
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.current.Method, claims)
+	token.Header["kid"] = k.current.Id
+	return token.SignedString(k.current.private)
+}
+
+// Keyfunc finds the key to verify token with, for jwt.Parse. Tokens
+// without a kid header are rejected.
+func (k *Keyring) Keyfunc(token *jwt.Token) (any, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if k.retired[kid] {
+		return nil, ErrKeyRetired
+	}
+	key, ok := k.byId[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w (kid %q)", ErrUnknownKey, kid)
+	}
+	// otherwise an RSA public key could be passed off as an HMAC secret
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, ErrWrongAlgorithm
+	}
+	return key.public, nil
+}
+
+// Algorithms returns the algorithms of the keys in the keyring
+func (k *Keyring) Algorithms() []string {
+	algorithms := []string{}
+	seen := map[string]bool{}
+	for _, key := range k.keys {
+		if !seen[key.Method.Alg()] {
+			seen[key.Method.Alg()] = true
+			algorithms = append(algorithms, key.Method.Alg())
+		}
+	}
+	return algorithms
+}
@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func newEd25519Key(t *testing.T, id string) *SigningKey {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &SigningKey{Id: id, Method: jwt.SigningMethodEdDSA, private: private, public: public}
+}
+
+func newHMACKey(t *testing.T, id string) *SigningKey {
+	t.Helper()
+	key, err := NewHMACKey(id, []byte("secret of "+id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newTokens(t *testing.T, keys []*SigningKey, retired ...string) *Tokens {
+	t.Helper()
+	keyring, err := NewKeyring(keys, retired...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Tokens{Keys: keyring, Audience: "chirpy-api"}
+}
+
+func TestSignNamesTheKey(t *testing.T) {
+	tokens := newTokens(t, []*SigningKey{newEd25519Key(t, "new"), newHMACKey(t, "old")})
+	signed, err := tokens.NewAccessToken("1", nil, nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := jwt.NewParser().ParseUnverified(signed, &Claims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := token.Header["kid"]; kid != "new" {
+		t.Errorf("the token names key %v, want new", kid)
+	}
+	if alg := token.Header["alg"]; alg != "EdDSA" {
+		t.Errorf("the token was signed with %v, want EdDSA", alg)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKey := newHMACKey(t, "old")
+	newKey := newHMACKey(t, "new")
+	before := newTokens(t, []*SigningKey{oldKey})
+	signed, err := before.NewAccessToken("1", nil, nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		after *Tokens
+		err   error
+	}{
+		{"old key still verifies", newTokens(t, []*SigningKey{newKey, oldKey}), nil},
+		{"old key retired", newTokens(t, []*SigningKey{newKey}, "old"), ErrKeyRetired},
+		{"old key dropped", newTokens(t, []*SigningKey{newKey}), ErrUnknownKey},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := test.after.ParseAccessToken(signed)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if err == nil && claims.Subject != "1" {
+				t.Errorf("got subject %q, want 1", claims.Subject)
+			}
+		})
+	}
+}
+
+func TestKeyfuncRejectsAlgorithmConfusion(t *testing.T) {
+	key := newEd25519Key(t, "ed")
+	tokens := newTokens(t, []*SigningKey{key, newHMACKey(t, "hmac")})
+	// an HS256 token "signed" with the public key, which verifiers of
+	// the wrong algorithm would take for the HMAC secret
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+		TokenType: AccessToken,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    Issuer,
+			Audience:  jwt.ClaimStrings{tokens.Audience},
+			Subject:   "1",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	})
+	forged.Header["kid"] = "ed"
+	signed, err := forged.SignedString([]byte(key.public.(ed25519.PublicKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tokens.ParseAccessToken(signed)
+	if !errors.Is(err, ErrWrongAlgorithm) {
+		t.Errorf("got error %v, want %v", err, ErrWrongAlgorithm)
+	}
+}
+
+func TestTokensWithoutKidAreRejected(t *testing.T) {
+	tokens, err := SecretKeyring("legacy secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// tokens signed before keys had ids
+	legacy := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+		TokenType: AccessToken,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    Issuer,
+			Audience:  jwt.ClaimStrings{"chirpy-api"},
+			Subject:   "1",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	})
+	signed, err := legacy.SignedString([]byte("legacy secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = (&Tokens{Keys: tokens, Audience: "chirpy-api"}).ParseAccessToken(signed)
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("a token without a kid returned %v, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestSecretKeyringIdIsStable(t *testing.T) {
+	a, err := SecretKeyring("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := SecretKeyring("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := SecretKeyring("another secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.current.Id != b.current.Id {
+		t.Errorf("the same secret got ids %s and %s", a.current.Id, b.current.Id)
+	}
+	if a.current.Id == c.current.Id {
+		t.Errorf("different secrets got the same id %s", a.current.Id)
+	}
+}
@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// recoveryCodeCount is how many recovery codes users get when they enable
+// two-factor authentication
+const recoveryCodeCount = 10
+
+// NewRecoveryCodes returns fresh recovery codes, to be shown to the user
+// once, and the hashes to store instead of them
+func NewRecoveryCodes() ([]string, []string, error) {
+	codes := []string{}
+	hashes := []string{}
+	for range recoveryCodeCount {
+		b := make([]byte, 6)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := hex.EncodeToString(b)
+		codes = append(codes, code[:4]+"-"+code[4:8]+"-"+code[8:])
+		hashes = append(hashes, HashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode gives the form recovery codes are stored and looked up
+// in. Like the codes of authenticators it ignores spaces and dashes, and
+// the codes are hex, so it ignores case too.
+func HashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(NormalizeCode(code))))
+	return hex.EncodeToString(sum[:])
+}
+
+// NormalizeCode strips what users type around codes: spaces and the dashes
+// of recovery codes
+func NormalizeCode(code string) string {
+	return strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(code))
+}
@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNewRecoveryCodes(t *testing.T) {
+	codes, hashes, err := NewRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(hashes), recoveryCodeCount)
+	}
+	for i, code := range codes {
+		if HashRecoveryCode(code) != hashes[i] {
+			t.Errorf("recovery code %s doesn't match its hash", code)
+		}
+		if slices.Contains(codes[:i], code) {
+			t.Errorf("recovery code %s was handed out twice", code)
+		}
+	}
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+	// recovery codes are stored hashed, so the hash of a code can't change
+	const want = "d407ad901895723f32d31e6515f5284beb4c01e70e56720d65099da4771f3193"
+	for _, code := range []string{"0123-4567-89ab", "0123456789ab", " 0123 4567 89AB "} {
+		if got := HashRecoveryCode(code); got != want {
+			t.Errorf("%q hashes to %s, want %s", code, got, want)
+		}
+	}
+	if HashRecoveryCode("0123-4567-89ac") == want {
+		t.Error("different codes have the same hash")
+	}
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// The scopes an access token can be limited to
+const (
+	// ScopeChirpsRead is implied: reading chirps is public, so no route
+	// requires it and every token may read them whatever its scopes
+	ScopeChirpsRead  = "chirps:read"
+	ScopeChirpsWrite = "chirps:write"
+	// ScopeAccountRead lists the user's sessions and personal access tokens
+	ScopeAccountRead  = "account:read"
+	ScopeAccountWrite = "account:write"
+	// ScopeAdmin is only granted to admins
+	ScopeAdmin = "admin"
+)
+
+// Scopes lists every scope there is
+var Scopes = []string{ScopeAccountRead, ScopeAccountWrite, ScopeAdmin, ScopeChirpsRead, ScopeChirpsWrite}
+
+// ErrUnknownScope is returned for requested scopes that don't exist
+var ErrUnknownScope = errors.New("unknown scope")
+
+// ParseScope reads a scope parameter: scopes separated by spaces
+// (RFC 6749, section 3.3). Asking for none means asking for all of them.
+func ParseScope(scope string) ([]string, error) {
+	requested := strings.Fields(scope)
+	if len(requested) == 0 {
+		return slices.Clone(Scopes), nil
+	}
+	for _, s := range requested {
+		if !slices.Contains(Scopes, s) {
+			return nil, fmt.Errorf("%w %q", ErrUnknownScope, s)
+		}
+	}
+	slices.Sort(requested)
+	return slices.Compact(requested), nil
+}
+
+// GrantedScopes returns the requested scopes a user may have. Only admins
+// get the admin scope; anyone else just gets a token without it.
+func GrantedScopes(requested []string, isAdmin bool) []string {
+	return slices.DeleteFunc(slices.Clone(requested), func(s string) bool {
+		return s == ScopeAdmin && !isAdmin
+	})
+}
@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Issuer is the iss claim of every token Chirpy signs
+const Issuer = "chirpy"
+
+// AccessToken is the token_type of tokens that authenticate API requests
+const AccessToken = "access"
+
+// MFAToken is the token_type of the challenges users with two-factor
+// authentication get for their password. They can only be exchanged for
+// access and refresh tokens together with a code.
+const MFAToken = "mfa"
+
+// MFATokenLifetime is how long users have to enter their code
+const MFATokenLifetime = 5 * time.Minute
+
+// Errors ParseAccessToken returns for the tokens it rejects. Their messages
+// are meant for clients.
+var (
+	ErrTokenMissing     = errors.New("the request has no credentials")
+	ErrTokenMalformed   = errors.New("the token is malformed")
+	ErrTokenIncomplete  = errors.New("the token is missing a required claim")
+	ErrTokenSignature   = errors.New("the token's signature is invalid")
+	ErrTokenExpired     = errors.New("the token has expired")
+	ErrTokenNotYetValid = errors.New("the token is not valid yet")
+	ErrTokenIssuer      = errors.New("the token wasn't issued by chirpy")
+	ErrTokenAudience    = errors.New("the token is meant for another audience")
+	ErrTokenType        = errors.New("the token is of the wrong type")
+)
+
+// Claims are the claims of the tokens Chirpy signs
+type Claims struct {
+	TokenType string `json:"token_type"`
+	// Scope lists what the token may be used for, separated by spaces
+	// (RFC 8693)
+	Scope string `json:"scope,omitempty"`
+	// Roles are the roles the user had when the token was signed, for
+	// services that only see the token
+	Roles []string `json:"roles,omitempty"`
+	// PasswordStamp identifies the password an MFA challenge was answered
+	// with, so the challenge is void once the password changes
+	PasswordStamp string `json:"password_stamp,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Scopes returns the scopes the token was granted
+func (c *Claims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// Tokens signs access tokens and checks the ones requests come with
+type Tokens struct {
+	Keys *Keyring
+	// Audience is the aud claim tokens are signed with and must have
+	Audience string
+	// Leeway is how far the clocks of other token issuers or verifiers may
+	// be off
+	Leeway time.Duration
+}
+
+// NewAccessToken returns an access token for the user, limited to scopes,
+// that is valid for lifetime
+func (t *Tokens) NewAccessToken(userId string, roles []string, scopes []string, lifetime time.Duration) (string, error) {
+	return t.Keys.Sign(t.claims(AccessToken, userId, roles, scopes, lifetime))
+}
+
+// ParseAccessToken verifies an access token and returns its claims. The
+// errors it returns are one of the Err variables of this package.
+func (t *Tokens) ParseAccessToken(tokenString string) (*Claims, error) {
+	return t.parse(tokenString, AccessToken)
+}
+
+// NewMFAToken returns the challenge a user who logged in with the password
+// of passwordStamp exchanges for tokens limited to scopes once they enter a
+// code. Each challenge has its own jti, so it can only be exchanged once.
+func (t *Tokens) NewMFAToken(userId string, passwordStamp string, scopes []string) (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	claims := t.claims(MFAToken, userId, nil, scopes, MFATokenLifetime)
+	claims.ID = hex.EncodeToString(b)
+	claims.PasswordStamp = passwordStamp
+	return t.Keys.Sign(claims)
+}
+
+// ParseMFAToken verifies an MFA challenge and returns its claims, with
+// the same errors as ParseAccessToken
+func (t *Tokens) ParseMFAToken(tokenString string) (*Claims, error) {
+	claims, err := t.parse(tokenString, MFAToken)
+	if err != nil {
+		return nil, err
+	}
+	if len(claims.ID) == 0 || len(claims.PasswordStamp) == 0 {
+		return nil, ErrTokenIncomplete
+	}
+	return claims, nil
+}
+
+func (t *Tokens) claims(tokenType string, userId string, roles []string, scopes []string, lifetime time.Duration) Claims {
+	now := time.Now()
+	return Claims{
+		TokenType: tokenType,
+		Scope:     strings.Join(scopes, " "),
+		Roles:     roles,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    Issuer,
+			Audience:  jwt.ClaimStrings{t.Audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(lifetime)),
+			Subject:   userId,
+		},
+	}
+}
+
+func (t *Tokens) parse(tokenString string, tokenType string) (*Claims, error) {
+	if len(tokenString) == 0 {
+		return nil, ErrTokenMissing
+	}
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, t.Keys.Keyfunc,
+		jwt.WithValidMethods(t.Keys.Algorithms()),
+		jwt.WithIssuer(Issuer),
+		jwt.WithAudience(t.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(t.Leeway),
+	)
+	if err != nil {
+		return nil, tokenError(err)
+	}
+	if claims.TokenType != tokenType {
+		return nil, ErrTokenType
+	}
+	if len(claims.Subject) == 0 {
+		return nil, ErrTokenIncomplete
+	}
+	return claims, nil
+}
+
+// tokenError translates the errors of the jwt package into ours
+func tokenError(err error) error {
+	switch {
+	case errors.Is(err, ErrUnknownKey):
+		return ErrUnknownKey
+	case errors.Is(err, ErrKeyRetired):
+		return ErrKeyRetired
+	case errors.Is(err, ErrWrongAlgorithm):
+		return ErrWrongAlgorithm
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid):
+		return ErrTokenSignature
+	case errors.Is(err, jwt.ErrTokenRequiredClaimMissing):
+		return ErrTokenIncomplete
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return ErrTokenExpired
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return ErrTokenNotYetValid
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		return ErrTokenIssuer
+	case errors.Is(err, jwt.ErrTokenInvalidAudience):
+		return ErrTokenAudience
+	default:
+		return ErrTokenMalformed
+	}
+}
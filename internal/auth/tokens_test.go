@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestParseAccessToken(t *testing.T) {
+	tokens := newTokens(t, []*SigningKey{newHMACKey(t, "key")})
+	other := newTokens(t, []*SigningKey{newHMACKey(t, "key")})
+	other.Audience = "another-api"
+	expired, err := tokens.NewAccessToken("1", nil, nil, -5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := tokens.NewAccessToken("1", []string{"admin"}, []string{ScopeChirpsWrite}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfa, err := tokens.NewMFAToken("1", "stamp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherType, err := tokens.Keys.Sign(Claims{
+		TokenType: "refresh",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    Issuer,
+			Audience:  jwt.ClaimStrings{tokens.Audience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			Subject:   "1",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		leeway time.Duration
+		err    error
+	}{
+		{"valid", valid, 0, nil},
+		{"missing", "", 0, ErrTokenMissing},
+		{"malformed", "not.a.token", 0, ErrTokenMalformed},
+		{"tampered", valid + "x", 0, ErrTokenSignature},
+		{"expired", expired, 0, ErrTokenExpired},
+		{"expired within leeway", expired, 10 * time.Second, nil},
+		{"expired beyond leeway", expired, time.Second, ErrTokenExpired},
+		{"another token type", otherType, 0, ErrTokenType},
+		{"MFA challenge", mfa, 0, ErrTokenType},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tokens.Leeway = test.leeway
+			_, err := tokens.ParseAccessToken(test.token)
+			if !errors.Is(err, test.err) {
+				t.Errorf("got error %v, want %v", err, test.err)
+			}
+		})
+	}
+
+	t.Run("other audience", func(t *testing.T) {
+		_, err := other.ParseAccessToken(valid)
+		if !errors.Is(err, ErrTokenAudience) {
+			t.Errorf("got error %v, want %v", err, ErrTokenAudience)
+		}
+	})
+
+	t.Run("claims", func(t *testing.T) {
+		tokens.Leeway = 0
+		claims, err := tokens.ParseAccessToken(valid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims.Subject != "1" || len(claims.Roles) != 1 || claims.Roles[0] != "admin" {
+			t.Errorf("got subject %q and roles %v", claims.Subject, claims.Roles)
+		}
+		if scopes := claims.Scopes(); len(scopes) != 1 || scopes[0] != ScopeChirpsWrite {
+			t.Errorf("got scopes %v", scopes)
+		}
+	})
+}
+
+func TestParseMFAToken(t *testing.T) {
+	tokens := newTokens(t, []*SigningKey{newHMACKey(t, "key")})
+	access, err := tokens.NewAccessToken("1", nil, nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tokens.ParseMFAToken(access)
+	if !errors.Is(err, ErrTokenType) {
+		t.Errorf("an access token was accepted as an MFA challenge: %v", err)
+	}
+	mfa, err := tokens.NewMFAToken("1", "stamp", []string{ScopeChirpsWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := tokens.ParseMFAToken(mfa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scopes := claims.Scopes(); len(scopes) != 1 || scopes[0] != ScopeChirpsWrite {
+		t.Errorf("got scopes %v", scopes)
+	}
+	if claims.PasswordStamp != "stamp" {
+		t.Errorf("got password stamp %q, want stamp", claims.PasswordStamp)
+	}
+	other, err := tokens.NewMFAToken("1", "stamp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherClaims, err := tokens.ParseMFAToken(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claims.ID) == 0 || claims.ID == otherClaims.ID {
+		t.Errorf("two challenges got the jtis %q and %q, want distinct ones", claims.ID, otherClaims.ID)
+	}
+
+	// a challenge needs a jti and a password stamp
+	for _, incomplete := range []func(claims *Claims){
+		func(claims *Claims) { claims.ID = "" },
+		func(claims *Claims) { claims.PasswordStamp = "" },
+	} {
+		claims := tokens.claims(MFAToken, "1", nil, nil, time.Minute)
+		claims.ID = "jti"
+		claims.PasswordStamp = "stamp"
+		incomplete(&claims)
+		token, err := tokens.Keys.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tokens.ParseMFAToken(token)
+		if !errors.Is(err, ErrTokenIncomplete) {
+			t.Errorf("a challenge with jti %q and password stamp %q returned %v, want %v", claims.ID, claims.PasswordStamp, err, ErrTokenIncomplete)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 secret of the test vectors of RFC 6238,
+// appendix B: "12345678901234567890" in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeMatchesRFC6238(t *testing.T) {
+	// the RFC's codes have 8 digits; ours are their last 6
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	key, err := totpEncoding.DecodeString(rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, vector := range vectors {
+		step := vector.unix / int64(totpPeriod.Seconds())
+		if code := totpCode(key, step); code != vector.code {
+			t.Errorf("the code at %d is %s, want %s", vector.unix, code, vector.code)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	at := time.Unix(1111111111, 0)
+	period := int64(totpPeriod.Seconds())
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		now    time.Time
+		ok     bool
+	}{
+		{"current code", rfc6238Secret, "050471", at, true},
+		{"lowercase secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", "050471", at, true},
+		{"one period late", rfc6238Secret, "050471", at.Add(totpPeriod), true},
+		{"one period early", rfc6238Secret, "050471", at.Add(-totpPeriod), true},
+		{"two periods late", rfc6238Secret, "050471", at.Add(2 * totpPeriod), false},
+		{"wrong code", rfc6238Secret, "050472", at, false},
+		{"not a code", rfc6238Secret, "05047a", at, false},
+		{"too short", rfc6238Secret, "50471", at, false},
+		{"bad secret", "not base32!", "050471", at, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			step, ok := ValidateTOTP(test.secret, test.code, test.now)
+			if ok != test.ok {
+				t.Fatalf("ValidateTOTP returned %t, want %t", ok, test.ok)
+			}
+			// the step is the one the code belongs to, not the current one
+			if ok && step != at.Unix()/period {
+				t.Errorf("the code was matched to step %d, want %d", step, at.Unix()/period)
+			}
+		})
+	}
+}
+
+func TestNewTOTPSecret(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("the secret %q is not base32: %s", secret, err)
+	}
+	now := time.Now()
+	code := totpCode(key, now.Unix()/int64(totpPeriod.Seconds()))
+	if _, ok := ValidateTOTP(secret, code, now); !ok {
+		t.Errorf("a code of the new secret wasn't accepted")
+	}
+}
@@ -0,0 +1,146 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStores returns an empty store of every backend
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	sqlite, err := NewSQLiteDB(filepath.Join(t.TempDir(), "chirpy.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlite.Close() })
+	return map[string]Store{
+		"memory": NewMemoryDB(),
+		"sqlite": sqlite,
+	}
+}
+
+func TestChirpTrash(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			chirp, err := store.CreateChirp("hello", "1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			steps := []struct {
+				name     string
+				restore  bool
+				userId   ID
+				moderate bool
+				err      error
+			}{
+				{"restore before deleting", true, "1", false, ErrChirpNotDeleted},
+				{"delete by someone else", false, "2", false, ErrNotChirpAuthor},
+				{"delete by the author", false, "1", false, nil},
+				{"delete twice", false, "1", false, ErrChirpNotFound},
+				{"restore by someone else", true, "2", false, ErrNotChirpAuthor},
+				{"restore by the author", true, "1", false, nil},
+				{"delete by a moderator", false, "9", true, nil},
+				{"restore by the author after a moderator", true, "1", false, ErrChirpModerated},
+				{"restore by a moderator", true, "9", true, nil},
+			}
+			for _, step := range steps {
+				if step.restore {
+					_, err = store.RestoreChirp(chirp.Id, step.userId, step.moderate)
+				} else {
+					err = store.DeleteChirp(chirp.Id, step.userId, step.moderate)
+				}
+				if !errors.Is(err, step.err) {
+					t.Fatalf("%s: got error %v, want %v", step.name, err, step.err)
+				}
+			}
+			_, err = store.GetSingleChirp(chirp.Id)
+			if err != nil {
+				t.Errorf("the restored chirp returned %v", err)
+			}
+		})
+	}
+}
+
+func TestPurgeDeletedChirps(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			kept, err := store.CreateChirp("kept", "1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			deleted, err := store.CreateChirp("deleted", "1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.DeleteChirp(deleted.Id, "1", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.GetSingleChirp(deleted.Id)
+			if !errors.Is(err, ErrChirpDeleted) {
+				t.Errorf("the deleted chirp returned %v, want %v", err, ErrChirpDeleted)
+			}
+
+			purged, err := store.PurgeDeletedChirps(time.Now().Add(-time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if purged != 0 {
+				t.Errorf("purged %d chirps deleted within the window", purged)
+			}
+			purged, err = store.PurgeDeletedChirps(time.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if purged != 1 {
+				t.Errorf("purged %d chirps, want 1", purged)
+			}
+			_, err = store.GetSingleChirp(deleted.Id)
+			if !errors.Is(err, ErrChirpNotFound) {
+				t.Errorf("the purged chirp returned %v, want %v", err, ErrChirpNotFound)
+			}
+			_, err = store.GetSingleChirp(kept.Id)
+			if err != nil {
+				t.Errorf("the chirp that wasn't deleted returned %v", err)
+			}
+		})
+	}
+}
+
+func TestConcurrentDeletesOfAChirp(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			chirp, err := store.CreateChirp("hello", "1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			errs := make(chan error, 10)
+			wg := sync.WaitGroup{}
+			for range cap(errs) {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errs <- store.DeleteChirp(chirp.Id, "1", false)
+				}()
+			}
+			wg.Wait()
+			close(errs)
+
+			deleted := 0
+			for err := range errs {
+				switch {
+				case err == nil:
+					deleted++
+				case !errors.Is(err, ErrChirpNotFound):
+					t.Errorf("got error %v", err)
+				}
+			}
+			if deleted != 1 {
+				t.Errorf("the chirp was deleted %d times", deleted)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package database
+
+import (
+	"bytes"
+	"chirpy/internal/keyid"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNoKey is returned when reading an encrypted file without the key it
+// was encrypted with
+var ErrNoKey = errors.New("the database is encrypted with a key that wasn't provided")
+
+// envelopeFormat marks a sealed file or log line. Sealed data always starts
+// with it, which is how it is told apart from plain JSON.
+const envelopeFormat = "aes-256-gcm-envelope"
+
+var envelopePrefix = []byte(`{"encryption":"` + envelopeFormat + `"`)
+
+// envelope is data encrypted with a random data key, which is itself
+// encrypted with a key from the keyring
+type envelope struct {
+	Encryption string `json:"encryption"`
+	KeyId      string `json:"key_id"`
+	WrappedKey []byte `json:"wrapped_key"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Keyring holds the keys database files are encrypted with. The first key
+// encrypts everything that is written; the others are only used to read
+// files written before a key rotation, until they are rewritten.
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// NewKeyring builds a keyring from base64 encoded 256-bit keys, the
+// current one first
+func NewKeyring(encodedKeys ...string) (*Keyring, error) {
+	if len(encodedKeys) == 0 {
+		return nil, errors.New("a keyring needs at least one key")
+	}
+	keyring := &Keyring{keys: map[string]cipher.AEAD{}}
+	for i, encoded := range encodedKeys {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("key %d is not valid base64: %w", i+1, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %d is %d bytes long instead of 32", i+1, len(key))
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		id := keyid.Derive(key)
+		if i == 0 {
+			keyring.current = id
+		}
+		keyring.keys[id] = aead
+	}
+	return keyring, nil
+}
+
+// NewKey returns a new random key in the form NewKeyring expects
+func NewKey() (string, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a new data key wrapped by the current key.
+// Without a keyring the data is returned as it is.
+func (k *Keyring) seal(plaintext []byte) ([]byte, error) {
+	if k == nil {
+		return plaintext, nil
+	}
+	dataKey := make([]byte, 32)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, data.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	kek := k.keys[k.current]
+	wrapNonce := make([]byte, kek.NonceSize())
+	_, err = rand.Read(wrapNonce)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(envelope{
+		Encryption: envelopeFormat,
+		KeyId:      k.current,
+		// the key id is authenticated so it can't be swapped
+		WrappedKey: kek.Seal(wrapNonce, wrapNonce, dataKey, []byte(k.current)),
+		Nonce:      nonce,
+		Ciphertext: data.Seal(nil, nonce, plaintext, nil),
+	})
+}
+
+// open returns the plaintext of data, which may be sealed or not. stale
+// reports whether data should be rewritten: it is plain while there is a
+// keyring, or sealed with a key other than the current one.
+func (k *Keyring) open(data []byte) (plaintext []byte, stale bool, err error) {
+	if !bytes.HasPrefix(data, envelopePrefix) {
+		return data, k != nil, nil
+	}
+	if k == nil {
+		return nil, false, ErrNoKey
+	}
+	sealed := envelope{}
+	err = json.Unmarshal(data, &sealed)
+	if err != nil {
+		return nil, false, err
+	}
+	kek, ok := k.keys[sealed.KeyId]
+	if !ok {
+		return nil, false, fmt.Errorf("%w (key id %s)", ErrNoKey, sealed.KeyId)
+	}
+	if len(sealed.WrappedKey) < kek.NonceSize() {
+		return nil, false, errors.New("the wrapped data key is truncated")
+	}
+	wrapNonce, wrapped := sealed.WrappedKey[:kek.NonceSize()], sealed.WrappedKey[kek.NonceSize():]
+	dataKey, err := kek.Open(nil, wrapNonce, wrapped, []byte(sealed.KeyId))
+	if err != nil {
+		return nil, false, fmt.Errorf("couldn't unwrap the data key: %w", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(sealed.Nonce) != aead.NonceSize() {
+		return nil, false, errors.New("the nonce has the wrong size")
+	}
+	plaintext, err = aead.Open(nil, sealed.Nonce, sealed.Ciphertext, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("couldn't decrypt: %w", err)
+	}
+	return plaintext, sealed.KeyId != k.current, nil
+}
@@ -0,0 +1,157 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestKey(t *testing.T) string {
+	t.Helper()
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newTestKeyring(t *testing.T, keys ...string) *Keyring {
+	t.Helper()
+	keyring, err := NewKeyring(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestKeyringSealOpen(t *testing.T) {
+	keyring := newTestKeyring(t, newTestKey(t))
+	plaintext := []byte(`{"chirps":{}}`)
+	sealed, err := keyring.seal(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, plaintext) {
+		t.Fatal("the sealed data contains the plaintext")
+	}
+	opened, stale, err := keyring.open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Errorf("opened %q, want %q", opened, plaintext)
+	}
+	if stale {
+		t.Error("data sealed with the current key is reported stale")
+	}
+
+	other, err := keyring.seal(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(sealed, other) {
+		t.Error("sealing the same data twice gave the same result")
+	}
+}
+
+func TestKeyringOpen(t *testing.T) {
+	oldKey := newTestKey(t)
+	newKey := newTestKey(t)
+	plaintext := []byte(`{"chirps":{}}`)
+	sealedWithOld, err := newTestKeyring(t, oldKey).seal(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Replace(sealedWithOld, []byte(`"ciphertext":"`), []byte(`"ciphertext":"AAAA`), 1)
+
+	tests := []struct {
+		name    string
+		keyring *Keyring
+		data    []byte
+		stale   bool
+		err     error
+	}{
+		{"rotated key", newTestKeyring(t, newKey, oldKey), sealedWithOld, true, nil},
+		{"key removed", newTestKeyring(t, newKey), sealedWithOld, false, ErrNoKey},
+		{"no keyring", nil, sealedWithOld, false, ErrNoKey},
+		{"plain with keyring", newTestKeyring(t, newKey), plaintext, true, nil},
+		{"plain without keyring", nil, plaintext, false, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opened, stale, err := test.keyring.open(test.data)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if !bytes.Equal(opened, plaintext) {
+				t.Errorf("opened %q, want %q", opened, plaintext)
+			}
+			if stale != test.stale {
+				t.Errorf("stale is %t, want %t", stale, test.stale)
+			}
+		})
+	}
+
+	t.Run("tampered", func(t *testing.T) {
+		_, _, err := newTestKeyring(t, oldKey).open(tampered)
+		if err == nil {
+			t.Error("tampered data was opened")
+		}
+	})
+}
+
+func TestNewKeyringRejectsBadKeys(t *testing.T) {
+	for _, keys := range [][]string{{}, {"not base64!"}, {"c2hvcnQ="}} {
+		_, err := NewKeyring(keys...)
+		if err == nil {
+			t.Errorf("NewKeyring(%q) succeeded", keys)
+		}
+	}
+}
+
+func TestKeyRotationRewritesDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	oldKey := newTestKey(t)
+	newKey := newTestKey(t)
+	db, err := NewDB(path, WithEncryption(newTestKeyring(t, oldKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateChirp("secret chirp", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// opening with the new key first rewrites everything with it
+	db, err = NewDB(path, WithEncryption(newTestKeyring(t, newKey, oldKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret chirp")) {
+		t.Fatal("the database file is in plain text")
+	}
+
+	db, err = NewDB(path, WithEncryption(newTestKeyring(t, newKey)))
+	if err != nil {
+		t.Fatalf("the rewritten database needs the old key: %v", err)
+	}
+	defer db.Close()
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 1 || chirps[0].Body != "secret chirp" {
+		t.Errorf("got chirps %v", chirps)
+	}
+}
@@ -1,383 +1,834 @@
 package database
 
 import (
-	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
-	"os"
-	"sort"
-	"strconv"
-	"strings"
+	"log"
 	"sync"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
+// DB keeps the whole database in memory and persists every change to its
+// storage. Reads are served from the cached state under mux.
 type DB struct {
-	mux  *sync.RWMutex
-	path string
+	mux     *sync.RWMutex
+	storage storage
+	state   DBStructure
+	indexes *indexes
+	ids     IDGenerator
+}
+
+// storage is where a DB persists its DBStructure
+type storage interface {
+	load() (DBStructure, error)
+	// append durably records changes before they are applied to the state
+	append(changes []change) error
+	// checkpoint gives the storage a chance to fold the recorded changes
+	// into a snapshot of the current state
+	checkpoint(dbStructure DBStructure) error
+	// seal encodes a copy of the state the way the storage would store it
+	seal(data []byte) ([]byte, error)
+	close() error
 }
 
 type Chirp struct {
-	Body     string `json:"body"`
-	Id       int    `json:"id"`
-	AuthorId int    `json:"author_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	Body      string     `json:"body"`
+	Id        ID         `json:"id"`
+	AuthorId  ID         `json:"author_id"`
+	DeletedBy ID         `json:"deleted_by,omitempty"`
+}
+
+// IsDeleted reports whether the chirp is in the trash
+func (c Chirp) IsDeleted() bool {
+	return c.DeletedAt != nil
+}
+
+// isModerated reports whether the chirp was deleted by someone other than
+// its author
+func (c Chirp) isModerated() bool {
+	return c.IsDeleted() && len(c.DeletedBy) > 0 && c.DeletedBy != c.AuthorId
 }
 
 type User struct {
-	ExpirationTime time.Time `json:"expiration_time"`
-	Password       string    `json:"password"`
-	Email          string    `json:"email"`
-	RefreshToken   string    `json:"refresh_token"`
-	Id             int       `json:"id"`
-	IsRedUser      bool      `json:"is_chirpy_red"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Password  string    `json:"password"`
+	Email     string    `json:"email"`
+	Roles     []string  `json:"roles,omitempty"`
+	Id        ID        `json:"id"`
+	IsRedUser bool      `json:"is_chirpy_red"`
+	// MFA is the user's two-factor authentication, nil until they set it
+	// up. The SQLite backend keeps it in a table of its own and leaves it
+	// nil here; use the Store's MFA methods instead.
+	MFA *MFA `json:"mfa,omitempty"`
+}
+
+// PasswordStamp identifies the user's current password without giving
+// away its hash, so a login that is only half done can tell whether the
+// password changed since
+func (u User) PasswordStamp() string {
+	sum := sha256.Sum256([]byte(u.Password))
+	return hex.EncodeToString(sum[:16])
 }
 
 type DBStructure struct {
-	Chirps map[int]Chirp `json:"chirps"`
-	Users  map[int]User  `json:"users"`
+	// SchemaVersion is the layout the file was written in, see migrations
+	SchemaVersion int            `json:"schema_version"`
+	Chirps        map[ID]Chirp   `json:"chirps"`
+	Users         map[ID]User    `json:"users"`
+	Sessions      map[ID]Session `json:"sessions"`
+	// PersonalTokens are the personal access tokens users created
+	PersonalTokens map[ID]PersonalToken `json:"personal_tokens"`
+	// Sequences are the per collection counters ids are generated from
+	Sequences map[string]uint64 `json:"sequences"`
+}
+
+// newDBStructure returns an empty database
+func newDBStructure() DBStructure {
+	return DBStructure{
+		SchemaVersion:  currentSchemaVersion,
+		Chirps:         map[ID]Chirp{},
+		Users:          map[ID]User{},
+		Sessions:       map[ID]Session{},
+		PersonalTokens: map[ID]PersonalToken{},
+		Sequences: map[string]uint64{
+			chirpSequence:         0,
+			userSequence:          0,
+			sessionSequence:       0,
+			personalTokenSequence: 0,
+		},
+	}
 }
 
 // NewDB creates a new database connection
-// and creates the database file if it doesn't exist
-func NewDB(path string) (*DB, error) {
-	db := DB{
-		mux:  &sync.RWMutex{},
-		path: path,
+// and creates the database file if it doesn't exist.
+// It fails with ErrLocked if another process has the database open.
+func NewDB(path string, options ...Option) (*DB, error) {
+	file := newFileStorage(path, options...)
+	err := file.acquireLock()
+	if err != nil {
+		return nil, err
+	}
+	err = file.ensureDB()
+	if err != nil {
+		file.close()
+		return nil, err
 	}
+	return openDB(file)
+}
 
-	err := db.ensureDB()
+// NewReadOnlyDB opens the database without taking the writer's lock, for
+// use while another process has it open. It serves the state as it was
+// when opened and every write fails with ErrReadOnly.
+func NewReadOnlyDB(path string, options ...Option) (*DB, error) {
+	file := newFileStorage(path, options...)
+	file.readOnly = true
+	return openDB(file)
+}
 
-	return &db, err
+// openDB loads the state from storage once; after that it is only written
+func openDB(storage storage) (*DB, error) {
+	state, err := storage.load()
+	if err != nil {
+		storage.close()
+		return nil, err
+	}
+	db := &DB{
+		mux:     &sync.RWMutex{},
+		storage: storage,
+		state:   state,
+		indexes: newIndexes(state),
+		ids:     CounterIDs{},
+	}
+	return db, nil
 }
 
-// CreateChirp creates a new chirp and saves it to disk
-func (db *DB) CreateChirp(body string, authorId int) (Chirp, error) {
+// SetIDGenerator changes how ids are generated for new records.
+// The default is CounterIDs.
+func (db *DB) SetIDGenerator(ids IDGenerator) {
 	db.mux.Lock()
 	defer db.mux.Unlock()
+	db.ids = ids
+}
 
-	database, err := db.loadDB()
+// CreateChirp creates a new chirp and saves it to disk
+func (db *DB) CreateChirp(body string, authorId ID) (Chirp, error) {
+	now := time.Now().UTC()
+	chirp := Chirp{
+		CreatedAt: now,
+		UpdatedAt: now,
+		Body:      body,
+		AuthorId:  authorId,
+	}
+	err := db.Update(func(tx *Tx) error {
+		id, err := tx.nextID(chirpSequence)
+		if err != nil {
+			return err
+		}
+		chirp.Id = id
+		return tx.PutChirp(chirp)
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
+	return chirp, nil
+}
 
-	max := 0
-	for key := range database.Chirps {
-		if key > max {
-			max = key
+// DeleteChirp moves a chirp to the trash, where its author can restore it
+// until ChirpRestoreWindow has passed. Only its author can delete it,
+// unless userId is deleting it as a moderator.
+func (db *DB) DeleteChirp(id ID, userId ID, moderate bool) error {
+	return db.Update(func(tx *Tx) error {
+		chirp, exists := tx.Chirp(id)
+		if !exists || chirp.IsDeleted() {
+			return ErrChirpNotFound
 		}
-	}
-	chirp := Chirp{
-		Body:     body,
-		Id:       max + 1,
-		AuthorId: authorId,
-	}
-	database.Chirps[chirp.Id] = chirp
-	err = db.writeDB(database)
+		if chirp.AuthorId != userId && !moderate {
+			return ErrNotChirpAuthor
+		}
+		now := time.Now().UTC()
+		chirp.DeletedAt = &now
+		chirp.DeletedBy = userId
+		return tx.PutChirp(chirp)
+	})
+}
+
+// RestoreChirp takes a chirp back out of the trash. Authors can only
+// restore the chirps they deleted themselves; moderators can restore any.
+func (db *DB) RestoreChirp(id ID, userId ID, moderate bool) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.Update(func(tx *Tx) error {
+		found, exists := tx.Chirp(id)
+		if !exists {
+			return ErrChirpNotFound
+		}
+		if found.AuthorId != userId && !moderate {
+			return ErrNotChirpAuthor
+		}
+		if !found.IsDeleted() {
+			return ErrChirpNotDeleted
+		}
+		if found.isModerated() && !moderate {
+			return ErrChirpModerated
+		}
+		if time.Since(*found.DeletedAt) > ChirpRestoreWindow {
+			return ErrRestoreWindowPassed
+		}
+		chirp = found
+		chirp.DeletedAt = nil
+		chirp.DeletedBy = ""
+		return tx.PutChirp(chirp)
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
 	return chirp, nil
 }
 
-func (db *DB) DeleteChirp(id int, authorId int) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-	database, err := db.loadDB()
+// PurgeDeletedChirps permanently removes the chirps deleted before
+// deletedBefore and returns how many there were
+func (db *DB) PurgeDeletedChirps(deletedBefore time.Time) (int, error) {
+	purged := 0
+	err := db.Update(func(tx *Tx) error {
+		for _, chirp := range tx.Chirps() {
+			if !chirp.IsDeleted() || !chirp.DeletedAt.Before(deletedBefore) {
+				continue
+			}
+			err := tx.DeleteChirp(chirp.Id)
+			if err != nil {
+				return err
+			}
+			purged++
+		}
+		return nil
+	})
 	if err != nil {
-		return err
-	}
-
-	chirp, exists := database.Chirps[id]
-	if !exists {
-		return errors.New("chirp not found")
-	}
-	if chirp.AuthorId != authorId {
-		return errors.New("the user is not authorised to delete this chirp")
+		return 0, err
 	}
+	return purged, nil
+}
 
-	delete(database.Chirps, id)
-	db.writeDB(database)
-	return nil
+func (db *DB) UpgradeUserToRed(id ID) error {
+	return db.Update(func(tx *Tx) error {
+		user, exists := tx.User(id)
+		if !exists {
+			return ErrUserNotFound
+		}
+		user.IsRedUser = true
+		user.UpdatedAt = time.Now().UTC()
+		return tx.PutUser(user)
+	})
 }
 
-func (db *DB) UpgradeUserToRed(id int) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
+// GetUserByEmail returns the user with the email, ignoring case
+func (db *DB) GetUserByEmail(email string) (User, error) {
+	user := User{}
+	err := db.View(func(tx *Tx) error {
+		found, ok := tx.UserByEmail(email)
+		if !ok {
+			return ErrUserNotFound
+		}
+		user = found
+		return nil
+	})
+	return user, err
+}
 
-	database, err := db.loadDB()
+// SetUserRoles replaces the roles the user was granted
+func (db *DB) SetUserRoles(id ID, roles []string) (User, error) {
+	roles, err := normalizeRoles(roles)
 	if err != nil {
-		return err
+		return User{}, err
 	}
-
 	user := User{}
-	for _, value := range database.Users {
-		if value.Id == id {
-			user = value
-			user.IsRedUser = true
+	err = db.Update(func(tx *Tx) error {
+		found, exists := tx.User(id)
+		if !exists {
+			return ErrUserNotFound
 		}
-	}
-
-	user, exists := database.Users[id]
-	if !exists {
-		return errors.New("user not found")
-	}
-	user.IsRedUser = true
-	database.Users[id] = user
-
-	err = db.writeDB(database)
+		user = found
+		user.Roles = roles
+		user.UpdatedAt = time.Now().UTC()
+		return tx.PutUser(user)
+	})
 	if err != nil {
-		return err
+		return User{}, err
 	}
-	return nil
+	return user, nil
+}
+
+// GetUser returns the user with the id
+func (db *DB) GetUser(id ID) (User, error) {
+	user := User{}
+	err := db.View(func(tx *Tx) error {
+		found, ok := tx.User(id)
+		if !ok {
+			return ErrUserNotFound
+		}
+		user = found
+		return nil
+	})
+	return user, err
 }
 
 // CreateUser creates a new user and saves it to disk
 func (db *DB) CreateUser(email string, password string) (User, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
-	database, err := db.loadDB()
+	hashedPassword, err := hashPassword(password)
 	if err != nil {
 		return User{}, err
 	}
-
-	max := 0
-	for key, value := range database.Users {
-		if key > max {
-			max = key
+	now := time.Now().UTC()
+	user := User{
+		CreatedAt: now,
+		UpdatedAt: now,
+		Password:  hashedPassword,
+		Email:     email,
+	}
+	err = db.Update(func(tx *Tx) error {
+		if _, exists := tx.UserByEmail(email); exists {
+			return errors.New("a user with this email already exists")
 		}
-		if strings.EqualFold(value.Email, email) {
-			return User{}, errors.New("a user with this email already exists")
+		id, err := tx.nextID(userSequence)
+		if err != nil {
+			return err
 		}
-	}
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+		user.Id = id
+		return tx.PutUser(user)
+	})
 	if err != nil {
 		return User{}, err
 	}
-	user := User{
-		Password: string(hashedPassword),
-		Email:    email,
-		Id:       max + 1,
+	return user, nil
+}
+
+// LoginUser checks the user's password and starts a new session for them
+// on the device. It returns the session's refresh token, which is only
+// stored hashed. Users with two-factor authentication get ErrMFARequired
+// and a Login without a session instead, see StartSession.
+func (db *DB) LoginUser(email string, password string, device Device, scopes []string) (Login, error) {
+	user := User{}
+	err := db.View(func(tx *Tx) error {
+		found, exists := tx.UserByEmail(email)
+		if !exists {
+			return errors.New("the user doesn't exist")
+		}
+		user = found
+		return nil
+	})
+	if err != nil {
+		return Login{}, err
 	}
-	database.Users[user.Id] = user
-	err = db.writeDB(database)
+	// bcrypt is slow on purpose, so compare outside of the lock
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
 	if err != nil {
-		return User{}, err
+		return Login{}, err
 	}
-	return user, nil
+	if user.MFA.IsEnabled() {
+		return Login{User: user}, ErrMFARequired
+	}
+	return db.startSession(user, device, scopes)
 }
 
-func (db *DB) LoginUser(email string, password string) (User, error) {
-	db.mux.RLock()
-	defer db.mux.RUnlock()
-	database, err := db.loadDB()
+// StartSession starts a new session for the user on the device, once
+// their second factor was checked after LoginUser. passwordStamp is the
+// User.PasswordStamp of the password they logged in with; if the password
+// changed since, StartSession fails with ErrPasswordChanged.
+func (db *DB) StartSession(userId ID, passwordStamp string, device Device, scopes []string) (Login, error) {
+	user, err := db.GetUser(userId)
 	if err != nil {
-		return User{}, err
-	}
-	user := User{}
-	for _, value := range database.Users {
-		if strings.EqualFold(value.Email, email) {
-			user = value
-		}
+		return Login{}, err
 	}
-	if len(user.Email) <= 0 {
-		return User{}, errors.New("the user doesn't exist")
+	if user.PasswordStamp() != passwordStamp {
+		return Login{}, ErrPasswordChanged
 	}
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	return db.startSession(user, device, scopes)
+}
+
+// startSession starts a session for the user as they were when they were
+// authenticated, failing if their password changed since
+func (db *DB) startSession(user User, device Device, scopes []string) (Login, error) {
+	session, refreshToken, err := newSession(user.Id, device, scopes)
 	if err != nil {
-		return User{}, err
+		return Login{}, err
 	}
-	b := make([]byte, 32)
-	_, err = rand.Read(b)
+	err = db.Update(func(tx *Tx) error {
+		current, exists := tx.User(user.Id)
+		if !exists || current.Password != user.Password {
+			return ErrPasswordChanged
+		}
+		user = current
+		id, err := tx.nextID(sessionSequence)
+		if err != nil {
+			return err
+		}
+		session.Id = id
+		return tx.PutSession(session)
+	})
 	if err != nil {
-		return User{}, err
+		return Login{}, err
 	}
-	user.RefreshToken = hex.EncodeToString(b)
-	user.ExpirationTime = time.Now().AddDate(0, 0, 60)
-	database.Users[user.Id] = user
-	db.writeDB(database)
-	return user, nil
+	return Login{User: user, Session: session, RefreshToken: refreshToken}, nil
 }
 
+// RevokeRefreshToken ends the session the refresh token belongs to, even
+// if it is an old one the session has rotated away from
 func (db *DB) RevokeRefreshToken(token string) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
+	return db.Update(func(tx *Tx) error {
+		session, exists := tx.SessionByTokenHash(hashToken(token))
+		if !exists {
+			return nil
+		}
+		return tx.DeleteSession(session.Id)
+	})
+}
 
-	database, err := db.loadDB()
+// RotateRefreshToken exchanges a refresh token for a new one of the same
+// session and returns the session's user along with it. Reusing a token
+// that was already exchanged revokes the session with ErrRefreshTokenReused.
+func (db *DB) RotateRefreshToken(token string, device Device) (Login, error) {
+	hash := hashToken(token)
+	login := Login{}
+	reused := false
+	err := db.Update(func(tx *Tx) error {
+		session, exists := tx.SessionByTokenHash(hash)
+		if !exists {
+			return ErrRefreshTokenInvalid
+		}
+		if session.TokenHash != hash {
+			reused = true
+			return tx.DeleteSession(session.Id)
+		}
+		if session.IsExpired() {
+			return ErrRefreshTokenExpired
+		}
+		user, exists := tx.User(session.UserId)
+		if !exists {
+			return ErrRefreshTokenInvalid
+		}
+		newToken, err := session.rotate(device.IP)
+		if err != nil {
+			return err
+		}
+		login = Login{User: user, Session: session, RefreshToken: newToken}
+		return tx.PutSession(session)
+	})
 	if err != nil {
-		return err
+		return Login{}, err
 	}
-	user := User{}
-	for _, value := range database.Users {
-		if strings.EqualFold(value.RefreshToken, token) {
-			user = value
-		}
+	if reused {
+		return Login{}, ErrRefreshTokenReused
 	}
-	if user.Id != 0 {
-		user.RefreshToken = ""
-		user.ExpirationTime = time.Now()
-		database.Users[user.Id] = user
-		db.writeDB(database)
+	return login, nil
+}
+
+// GetSessions returns the user's sessions that haven't expired, oldest first
+func (db *DB) GetSessions(userId ID) ([]Session, error) {
+	sessions := []Session{}
+	err := db.View(func(tx *Tx) error {
+		for _, session := range tx.SessionsByUser(userId) {
+			if !session.IsExpired() {
+				sessions = append(sessions, session)
+			}
+		}
+		return nil
+	})
+	return sessions, err
+}
+
+// DeleteSession ends one of the user's sessions
+func (db *DB) DeleteSession(id ID, userId ID) error {
+	return db.Update(func(tx *Tx) error {
+		session, exists := tx.Session(id)
+		if !exists || session.UserId != userId {
+			return ErrSessionNotFound
+		}
+		return tx.DeleteSession(id)
+	})
+}
+
+// DeleteSessions ends all of the user's sessions, logging them out
+// everywhere, and returns how many there were
+func (db *DB) DeleteSessions(userId ID) (int, error) {
+	deleted := 0
+	err := db.Update(func(tx *Tx) error {
+		for _, session := range tx.SessionsByUser(userId) {
+			err := tx.DeleteSession(session.Id)
+			if err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
-	return nil
+	return deleted, nil
 }
 
-func (db *DB) GetUserByRefreshToken(token string) (User, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-	database, err := db.loadDB()
+// CreatePersonalToken creates a personal access token for the user and
+// returns it together with the token itself, which is only stored hashed
+func (db *DB) CreatePersonalToken(userId ID, name string, scopes []string) (PersonalToken, string, error) {
+	token, secret, err := newPersonalToken(userId, name, scopes)
 	if err != nil {
-		return User{}, err
+		return PersonalToken{}, "", err
 	}
-	user := User{}
-	for _, value := range database.Users {
-		if strings.EqualFold(value.RefreshToken, token) {
-			user = value
+	err = db.Update(func(tx *Tx) error {
+		if _, exists := tx.User(userId); !exists {
+			return ErrUserNotFound
+		}
+		id, err := tx.nextID(personalTokenSequence)
+		if err != nil {
+			return err
 		}
+		token.Id = id
+		return tx.PutPersonalToken(token)
+	})
+	if err != nil {
+		return PersonalToken{}, "", err
 	}
-	return user, nil
+	return token, secret, nil
 }
 
-// UpdateUser user updates the given user and returns the updated user
-func (db *DB) UpdateUser(id string, email string, password string) (User, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-	database, err := db.loadDB()
+// GetPersonalTokens returns the user's personal access tokens, oldest first
+func (db *DB) GetPersonalTokens(userId ID) ([]PersonalToken, error) {
+	tokens := []PersonalToken{}
+	err := db.View(func(tx *Tx) error {
+		tokens = append(tokens, tx.PersonalTokensByUser(userId)...)
+		return nil
+	})
+	return tokens, err
+}
+
+// UsePersonalToken returns the personal access token a request is made
+// with and records that it was used
+func (db *DB) UsePersonalToken(token string) (PersonalToken, error) {
+	hash := hashToken(token)
+	found := PersonalToken{}
+	err := db.View(func(tx *Tx) error {
+		personalToken, exists := tx.PersonalTokenByHash(hash)
+		if !exists {
+			return ErrPersonalTokenInvalid
+		}
+		found = personalToken
+		return nil
+	})
 	if err != nil {
-		return User{}, err
+		return PersonalToken{}, err
 	}
-	idInt, err := strconv.Atoi(id)
+	if !found.use() {
+		return found, nil
+	}
+	err = db.Update(func(tx *Tx) error {
+		current, exists := tx.PersonalToken(found.Id)
+		if !exists {
+			return ErrPersonalTokenInvalid
+		}
+		current.LastUsedAt = found.LastUsedAt
+		found = current
+		return tx.PutPersonalToken(current)
+	})
 	if err != nil {
-		return User{}, err
+		return PersonalToken{}, err
 	}
-	user, exists := database.Users[idInt]
-	if !exists {
-		return User{}, errors.New("user not found")
+	return found, nil
+}
+
+// DeletePersonalToken revokes one of the user's personal access tokens
+func (db *DB) DeletePersonalToken(id ID, userId ID) error {
+	return db.Update(func(tx *Tx) error {
+		token, exists := tx.PersonalToken(id)
+		if !exists || token.UserId != userId {
+			return ErrPersonalTokenNotFound
+		}
+		return tx.DeletePersonalToken(id)
+	})
+}
+
+// EnrollMFA starts setting up two-factor authentication for the user with
+// a new secret, which EnableMFA enables. It returns the user.
+func (db *DB) EnrollMFA(userId ID, secret string) (User, error) {
+	user := User{}
+	err := db.Update(func(tx *Tx) error {
+		found, exists := tx.User(userId)
+		if !exists {
+			return ErrUserNotFound
+		}
+		if found.MFA.IsEnabled() {
+			return ErrMFAEnabled
+		}
+		user = found
+		user.MFA = &MFA{Secret: secret}
+		return tx.PutUser(user)
+	})
+	if err != nil {
+		return User{}, err
 	}
+	return user, nil
+}
+
+// GetMFA returns the user's two-factor authentication
+func (db *DB) GetMFA(userId ID) (MFA, error) {
+	mfa := MFA{}
+	err := db.View(func(tx *Tx) error {
+		user, exists := tx.User(userId)
+		if !exists {
+			return ErrUserNotFound
+		}
+		if user.MFA == nil {
+			return ErrMFANotEnrolled
+		}
+		mfa = *user.MFA.clone()
+		return nil
+	})
+	return mfa, err
+}
+
+// EnableMFA enables two-factor authentication for the user once they
+// entered a code of the secret from EnrollMFA, from time step step
+func (db *DB) EnableMFA(userId ID, step int64, recoveryCodeHashes []string) error {
+	return db.updateMFA(userId, func(mfa *MFA, now time.Time) error {
+		return mfa.enable(step, recoveryCodeHashes, now)
+	})
+}
+
+// UseMFAStep accepts a code of the user's authenticator from time step
+// step, once
+func (db *DB) UseMFAStep(userId ID, step int64) error {
+	return db.updateMFA(userId, func(mfa *MFA, now time.Time) error {
+		return mfa.useStep(step, now)
+	})
+}
+
+// UseRecoveryCode accepts the user's recovery code with the hash and uses
+// it up
+func (db *DB) UseRecoveryCode(userId ID, hash string) error {
+	return db.updateMFA(userId, func(mfa *MFA, now time.Time) error {
+		return mfa.useRecoveryCode(hash, now)
+	})
+}
+
+// UseMFAChallenge marks the user's MFA token with jti id, which expires at
+// expiresAt, as exchanged for a login, once
+func (db *DB) UseMFAChallenge(userId ID, id string, expiresAt time.Time) error {
+	return db.updateMFA(userId, func(mfa *MFA, now time.Time) error {
+		return mfa.useChallenge(id, expiresAt, now)
+	})
+}
+
+// RecordMFAFailure counts a wrong code of the user, which locks their
+// second factor after too many in a row
+func (db *DB) RecordMFAFailure(userId ID) error {
+	return db.updateMFA(userId, (*MFA).recordFailure)
+}
 
+// updateMFA applies change to the user's two-factor authentication and
+// saves it unless change fails
+func (db *DB) updateMFA(userId ID, change func(mfa *MFA, now time.Time) error) error {
+	return db.Update(func(tx *Tx) error {
+		user, exists := tx.User(userId)
+		if !exists {
+			return ErrUserNotFound
+		}
+		if user.MFA == nil {
+			return ErrMFANotEnrolled
+		}
+		mfa := user.MFA.clone()
+		err := change(mfa, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		user.MFA = mfa
+		return tx.PutUser(user)
+	})
+}
+
+// DisableMFA turns off the user's two-factor authentication
+func (db *DB) DisableMFA(userId ID) error {
+	return db.Update(func(tx *Tx) error {
+		user, exists := tx.User(userId)
+		if !exists {
+			return ErrUserNotFound
+		}
+		if user.MFA == nil {
+			return ErrMFANotEnrolled
+		}
+		user.MFA = nil
+		return tx.PutUser(user)
+	})
+}
+
+// UpdateUser user updates the given user and returns the updated user
+func (db *DB) UpdateUser(id ID, email string, password string) (User, error) {
+	hashedPassword := ""
+	var err error
 	if len(password) > 0 {
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+		hashedPassword, err = hashPassword(password)
 		if err != nil {
 			return User{}, err
 		}
-		user.Password = string(hashedPassword)
-	}
-	if len(email) > 0 {
-		user.Email = email
 	}
-	database.Users[idInt] = user
-	err = db.writeDB(database)
+
+	user := User{}
+	err = db.Update(func(tx *Tx) error {
+		found, exists := tx.User(id)
+		if !exists {
+			return ErrUserNotFound
+		}
+		user = found
+		if len(hashedPassword) > 0 {
+			user.Password = hashedPassword
+		}
+		if len(email) > 0 {
+			owner, taken := tx.UserByEmail(email)
+			if taken && owner.Id != user.Id {
+				return errors.New("a user with this email already exists")
+			}
+			user.Email = email
+		}
+		user.UpdatedAt = time.Now().UTC()
+		return tx.PutUser(user)
+	})
 	if err != nil {
 		return User{}, err
 	}
 	return user, nil
 }
 
-// GetChirps returns all chirps in the database
+// GetChirps returns all chirps in the database that aren't in the trash
 func (db *DB) GetChirps() ([]Chirp, error) {
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+	chirps := []Chirp{}
+	err := db.View(func(tx *Tx) error {
+		chirps = withoutDeleted(tx.Chirps())
+		return nil
+	})
+	return chirps, err
+}
 
-	database, err := db.loadDB()
-	if err != nil {
-		return []Chirp{}, err
-	}
+// GetChirpsByAuthor returns the chirps written by the given user
+// that aren't in the trash
+func (db *DB) GetChirpsByAuthor(authorId ID) ([]Chirp, error) {
 	chirps := []Chirp{}
-	for _, value := range database.Chirps {
-		chirps = append(chirps, value)
-	}
-	sort.Slice(chirps, func(i, j int) bool {
-		return chirps[i].Id < chirps[j].Id
+	err := db.View(func(tx *Tx) error {
+		chirps = withoutDeleted(tx.ChirpsByAuthor(authorId))
+		return nil
 	})
-	return chirps, nil
+	return chirps, err
 }
 
-func (db *DB) GetSingleChirp(id int) (Chirp, error) {
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+// GetSingleChirp returns the chirp, or ErrChirpDeleted if it is in the trash
+func (db *DB) GetSingleChirp(id ID) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.View(func(tx *Tx) error {
+		found, ok := tx.Chirp(id)
+		if !ok {
+			return ErrChirpNotFound
+		}
+		if found.IsDeleted() {
+			return ErrChirpDeleted
+		}
+		chirp = found
+		return nil
+	})
+	return chirp, err
+}
 
-	database, err := db.loadDB()
-	if err != nil {
-		return Chirp{}, err
-	}
-	chirp, ok := database.Chirps[id]
-	if !ok {
-		return Chirp{}, errors.New("doesn't exist")
+func withoutDeleted(chirps []Chirp) []Chirp {
+	visible := []Chirp{}
+	for _, chirp := range chirps {
+		if !chirp.IsDeleted() {
+			visible = append(visible, chirp)
+		}
 	}
-	return chirp, nil
+	return visible
 }
 
-// ensureDB creates a new database file if it doesn't exist
-func (db *DB) ensureDB() error {
+// Close flushes and releases the underlying storage
+func (db *DB) Close() error {
 	db.mux.Lock()
 	defer db.mux.Unlock()
+	return db.storage.close()
+}
 
-	stat, err := os.Stat(db.path)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return db.initializeDB()
+// commit persists changes and then applies them to the cached state.
+// The changes are validated first, so once they are in the log applying
+// them can't fail and the cache never falls behind it. Callers must hold
+// the write lock.
+func (db *DB) commit(changes ...change) error {
+	for _, c := range changes {
+		err := c.validate()
+		if err != nil {
+			return err
 		}
-		return err
-	}
-
-	if stat.Size() == 0 {
-		return db.initializeDB()
 	}
-
-	return nil
-}
-
-func (db *DB) initializeDB() error {
-	file, err := os.Create(db.path)
+	err := db.storage.append(changes)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	// Initialize with an empty structure
-	dbStructure := DBStructure{
-		Chirps: make(map[int]Chirp),
-		Users:  map[int]User{},
-	}
-
-	// Convert the structure to JSON and write it to the file
-	encoder := json.NewEncoder(file)
-	if err := encoder.Encode(dbStructure); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-// loadDB reads the database file into memory
-func (db *DB) loadDB() (DBStructure, error) {
-	dbStructure := DBStructure{}
-
-	bs, err := os.ReadFile(db.path)
-	if err != nil {
-		return DBStructure{}, err
+	for _, c := range changes {
+		db.indexes.update(db.state, c)
+		db.state.apply(c)
 	}
 
-	err = json.Unmarshal(bs, &dbStructure)
+	// the changes are already durable, so a failed checkpoint only
+	// means the log keeps growing until the next one succeeds
+	err = db.storage.checkpoint(db.state)
 	if err != nil {
-		return DBStructure{}, err
+		log.Printf("Couldn't checkpoint the database: %s", err)
 	}
-
-	return dbStructure, nil
+	return nil
 }
 
-// writeDB writes the database file to disk
-func (db *DB) writeDB(dbStructure DBStructure) error {
-	data, err := json.Marshal(dbStructure)
-	if err != nil {
-		return err
-	}
-	err = os.WriteFile(db.path, data, 0600)
+func hashPassword(password string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 10)
 	if err != nil {
-		return err
+		return "", err
 	}
-	return nil
+	return string(hashedPassword), nil
 }
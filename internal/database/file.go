@@ -0,0 +1,441 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fileStorage keeps the database in a JSON snapshot file on disk plus a
+// write-ahead log of the changes made since. Every snapshot replaces the
+// file atomically, and the previous version is kept next to it as a backup
+// to recover from if the file is damaged.
+//
+// A writable fileStorage holds an advisory lock on path.lock for as long as
+// it is open, so a second process can only open the database read-only.
+type fileStorage struct {
+	path     string
+	wal      *writeAheadLog
+	lock     *os.File
+	readOnly bool
+	// keys encrypt the snapshot and the log when set
+	keys *Keyring
+	// rewrite is set by read when the files on disk are from an older
+	// schema version or aren't encrypted the way they would be written now
+	rewrite bool
+	// recovered is set by loadSnapshot when the file was unreadable and the
+	// backup, last written at backupTime, was read instead
+	recovered  bool
+	backupTime time.Time
+}
+
+// Option configures how a database file is stored
+type Option func(f *fileStorage)
+
+// WithEncryption encrypts the database file, its backup and its log with
+// keys. Files written in plain text or with an older key of the keyring
+// are read and then rewritten with the current key.
+func WithEncryption(keys *Keyring) Option {
+	return func(f *fileStorage) {
+		f.keys = keys
+		f.wal.keys = keys
+	}
+}
+
+func newFileStorage(path string, options ...Option) *fileStorage {
+	f := &fileStorage{
+		path: path,
+		wal:  &writeAheadLog{path: path + ".wal"},
+	}
+	for _, option := range options {
+		option(f)
+	}
+	return f
+}
+
+// acquireLock takes the lock that makes this process the only writer
+func (f *fileStorage) acquireLock() error {
+	lock, err := lockFile(f.path + ".lock")
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.path, err)
+	}
+	f.lock = lock
+	return nil
+}
+
+func (f *fileStorage) backupPath() string {
+	return f.path + ".bak"
+}
+
+// ensureDB creates a new database file if neither it nor a backup exists
+func (f *fileStorage) ensureDB() error {
+	_, err := os.Stat(f.path)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	_, err = os.Stat(f.backupPath())
+	if err == nil {
+		// the backup is recovered by load
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return f.initializeDB()
+}
+
+func (f *fileStorage) initializeDB() error {
+	// Initialize with an empty structure
+	return f.write(newDBStructure())
+}
+
+// load reads the database into memory and opens the log for appending.
+// Files from an older schema version are rewritten in the current one.
+func (f *fileStorage) load() (DBStructure, error) {
+	if f.readOnly {
+		// leave the upgrade to the process that holds the lock
+		return f.readConsistent()
+	}
+	dbStructure, err := f.read()
+	if err != nil {
+		return DBStructure{}, err
+	}
+	err = f.wal.open()
+	if err != nil {
+		return DBStructure{}, err
+	}
+	if f.rewrite || f.wal.stale {
+		err = f.write(dbStructure)
+		if err != nil {
+			return DBStructure{}, err
+		}
+		// the old log is folded into the snapshot and kept as history
+		err = f.wal.rotate()
+		if err != nil {
+			return DBStructure{}, err
+		}
+		f.rewrite = false
+	}
+	return dbStructure, nil
+}
+
+// read returns the snapshot with the log replayed on top of it, migrated
+// to the current schema version
+func (f *fileStorage) read() (DBStructure, error) {
+	doc, err := f.loadSnapshot()
+	if err != nil {
+		return DBStructure{}, err
+	}
+	version, err := doc.schemaVersion()
+	if err != nil {
+		return DBStructure{}, err
+	}
+	if version == currentSchemaVersion {
+		dbStructure, err := doc.decode()
+		if err != nil {
+			return DBStructure{}, err
+		}
+		err = f.replay(dbStructure.applyEntry)
+		if err != nil {
+			return DBStructure{}, err
+		}
+		return dbStructure, nil
+	}
+
+	// the log was written in the same version as the snapshot, so it is
+	// replayed before migrating
+	err = f.replay(doc.applyEntry)
+	if err != nil {
+		return DBStructure{}, err
+	}
+	err = doc.migrate()
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("%s: %w", f.path, err)
+	}
+	f.rewrite = true
+	return doc.decode()
+}
+
+// readConsistent reads the database without the lock, while the process
+// that holds it may be writing. A checkpoint in the middle of the read
+// would pair the old snapshot with the new, empty log, so the read is
+// retried until the snapshot is the same file before and after it. The
+// other way around, the new snapshot with the old log, is harmless.
+func (f *fileStorage) readConsistent() (DBStructure, error) {
+	for attempt := 1; ; attempt++ {
+		before, err := statIfExists(f.path)
+		if err != nil {
+			return DBStructure{}, err
+		}
+		dbStructure, err := f.read()
+		after, statErr := statIfExists(f.path)
+		if statErr != nil {
+			return DBStructure{}, statErr
+		}
+		if sameFile(before, after) {
+			return dbStructure, err
+		}
+		if attempt == maxReadAttempts {
+			return DBStructure{}, fmt.Errorf("%s kept changing while it was read", f.path)
+		}
+		f.wal = &writeAheadLog{path: f.wal.path, keys: f.keys}
+		f.recovered = false
+	}
+}
+
+// maxReadAttempts is how often readConsistent tries to read the database
+const maxReadAttempts = 5
+
+// statIfExists returns nil for a file that doesn't exist
+func statIfExists(path string) (os.FileInfo, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return info, err
+}
+
+// sameFile reports whether two stats of a path found the same, unchanged
+// file, or no file both times
+func sameFile(a os.FileInfo, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+// replay applies the log to the snapshot read by loadSnapshot. The backup
+// is the snapshot before the last checkpoint, so when it was read instead
+// the segments archived since it was written go first. Some of their
+// changes may already be in it, which is harmless.
+func (f *fileStorage) replay(applyEntry func(line []byte) error) error {
+	if f.recovered {
+		segments, err := f.wal.segmentsSince(f.backupTime)
+		if err != nil {
+			return err
+		}
+		for _, segment := range segments {
+			history := &writeAheadLog{path: segment, keys: f.keys}
+			err = history.replay(applyEntry)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return f.wal.replay(applyEntry)
+}
+
+// PendingMigrations describes the migrations NewDB will apply to the
+// database at path, without changing anything
+func PendingMigrations(path string, options ...Option) ([]string, error) {
+	file := newFileStorage(path, options...)
+	file.readOnly = true
+	doc, err := file.loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	pending, err := doc.pendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+	descriptions := []string{}
+	for _, m := range pending {
+		descriptions = append(descriptions, m.description)
+	}
+	return descriptions, nil
+}
+
+// append records changes in the log; they reach the snapshot on the next checkpoint
+func (f *fileStorage) append(changes []change) error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
+	return f.wal.append(changes)
+}
+
+// checkpoint folds the log into a new snapshot once it has grown past
+// compactAfter entries. The old log is kept as a history segment.
+func (f *fileStorage) checkpoint(dbStructure DBStructure) error {
+	if f.readOnly || f.wal.entries < compactAfter {
+		return nil
+	}
+	err := f.write(dbStructure)
+	if err != nil {
+		return err
+	}
+	return f.wal.rotate()
+}
+
+func (f *fileStorage) close() error {
+	err := f.wal.close()
+	if f.lock != nil {
+		unlockErr := unlockFile(f.lock)
+		f.lock = nil
+		if err == nil {
+			err = unlockErr
+		}
+	}
+	return err
+}
+
+// loadSnapshot reads the database file. A missing, empty or unparsable
+// file is set aside and the last good backup is read instead; load writes
+// the recovered state back once the log is replayed.
+func (f *fileStorage) loadSnapshot() (rawDB, error) {
+	doc, stale, err := readDBFile(f.path, f.keys)
+	if errors.Is(err, ErrNoKey) {
+		// the backup is encrypted the same way, so there is nothing to recover
+		return nil, fmt.Errorf("%s: %w", f.path, err)
+	}
+	if err == nil {
+		f.rewrite = f.rewrite || stale
+		return doc, nil
+	}
+
+	backup, _, backupErr := readDBFile(f.backupPath(), f.keys)
+	if backupErr != nil {
+		return nil, fmt.Errorf("%s is unreadable (%w) and so is its backup (%v)", f.path, err, backupErr)
+	}
+	log.Printf("%s is unreadable (%v), recovering from %s", f.path, err, f.backupPath())
+	info, err := os.Stat(f.backupPath())
+	if err != nil {
+		return nil, err
+	}
+	f.recovered = true
+	f.backupTime = info.ModTime()
+	if f.readOnly {
+		// leave the repair to the process that holds the lock
+		return backup, nil
+	}
+
+	if _, statErr := os.Stat(f.path); statErr == nil {
+		corruptPath := fmt.Sprintf("%s.corrupt-%d", f.path, time.Now().Unix())
+		err = os.Rename(f.path, corruptPath)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("The damaged file was moved to %s", corruptPath)
+	}
+	f.rewrite = true
+	return backup, nil
+}
+
+// write replaces the snapshot with dbStructure. The new contents are
+// written to a temporary file and fsynced before being renamed over the old
+// file, so a crash leaves either the old or the new version, never a mix.
+func (f *fileStorage) write(dbStructure DBStructure) error {
+	data, err := json.Marshal(dbStructure)
+	if err != nil {
+		return err
+	}
+	data, err = f.keys.seal(data)
+	if err != nil {
+		return err
+	}
+
+	// keep the current version around as the backup; a hard link is
+	// enough because the rename below swaps in a new inode. Without a
+	// current version, while recovering from the backup, it stays as is.
+	linkPath := f.backupPath() + ".tmp"
+	err = os.Remove(linkPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	err = os.Link(f.path, linkPath)
+	if err == nil {
+		err = os.Rename(linkPath, f.backupPath())
+	} else if !errors.Is(err, os.ErrNotExist) {
+		// file systems without hard links get a copy instead
+		err = copyFileAtomic(f.path, f.backupPath())
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return writeFileAtomic(f.path, data)
+}
+
+func (f *fileStorage) seal(data []byte) ([]byte, error) {
+	return f.keys.seal(data)
+}
+
+// readDBFile decrypts and parses a database file, treating an empty file
+// as damaged. stale reports whether the file should be encrypted again.
+func readDBFile(path string, keys *Keyring) (doc rawDB, stale bool, err error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	bs, stale, err = keys.open(bs)
+	if err != nil {
+		return nil, false, err
+	}
+	doc, err = parseRawDB(bs)
+	return doc, stale, err
+}
+
+// copyFileAtomic replaces dst with a copy of src the way writeFileAtomic
+// writes it
+func copyFileAtomic(src string, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dst, data)
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory,
+// fsyncs it and renames it over path
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	// a no-op once the rename succeeded
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Chmod(0600)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir fsyncs a directory so a rename inside it survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
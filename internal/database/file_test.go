@@ -0,0 +1,322 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// damage overwrites the database file with something that doesn't parse
+func damage(t *testing.T, path string) {
+	t.Helper()
+	err := os.WriteFile(path, []byte("{\"chirps\": {"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverFromBackupKeepsCheckpointedChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two checkpoints, so the backup is one behind the file
+	count := 2*compactAfter + 5
+	for i := range count {
+		_, err := db.CreateChirp(fmt.Sprintf("chirp %d", i+1), "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	damage(t, path)
+	db, err = NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != count {
+		t.Fatalf("recovered %d chirps, want %d", len(chirps), count)
+	}
+	chirp, err := db.CreateChirp("after recovering", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ID(fmt.Sprint(count + 1)); chirp.Id != want {
+		t.Errorf("the next chirp got id %s, want %s", chirp.Id, want)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the recovered state was written back, so damaging the file again
+	// before the next checkpoint loses nothing either
+	damage(t, path)
+	db, err = NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	chirps, err = db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != count+1 {
+		t.Fatalf("recovered %d chirps the second time, want %d", len(chirps), count+1)
+	}
+}
+
+func TestReadOnlyDBRecoversFromBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := compactAfter + 5
+	for i := range count {
+		_, err := db.CreateChirp(fmt.Sprintf("chirp %d", i+1), "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer db.Close()
+
+	damage(t, path)
+	readOnly, err := NewReadOnlyDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readOnly.Close()
+	chirps, err := readOnly.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != count {
+		t.Fatalf("read %d chirps, want %d", len(chirps), count)
+	}
+}
+
+func TestReadOnlyDBDuringCheckpoints(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	committed := make(chan int, 3*compactAfter)
+	go func() {
+		defer close(committed)
+		for i := range 3 * compactAfter {
+			_, err := db.CreateChirp(fmt.Sprintf("chirp %d", i+1), "1")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			committed <- i + 1
+		}
+	}()
+
+	// every read sees at least the chirps committed before it started,
+	// even when a checkpoint archives the log in the middle of it
+	count := 0
+	for count < 3*compactAfter {
+		for drained := false; !drained; {
+			select {
+			case n, ok := <-committed:
+				if !ok {
+					return
+				}
+				count = n
+			default:
+				drained = true
+			}
+		}
+		readOnly, err := NewReadOnlyDB(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chirps, err := readOnly.GetChirps()
+		readOnly.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chirps) < count {
+			t.Fatalf("read %d chirps after %d were committed", len(chirps), count)
+		}
+	}
+}
+
+// tornFile fails the next write after writing only half of it, the way a
+// full disk does, and can fail to truncate as well
+type tornFile struct {
+	logFile
+	tear          bool
+	truncateFails bool
+}
+
+func (f *tornFile) Write(p []byte) (int, error) {
+	if !f.tear {
+		return f.logFile.Write(p)
+	}
+	f.tear = false
+	n, _ := f.logFile.Write(p[:len(p)/2])
+	return n, errors.New("no space left on device")
+}
+
+func (f *tornFile) Truncate(size int64) error {
+	if f.truncateFails {
+		return errors.New("input/output error")
+	}
+	return f.logFile.Truncate(size)
+}
+
+// walFile swaps the log file of db for a tornFile
+func walFile(t *testing.T, db *DB) *tornFile {
+	t.Helper()
+	wal := db.storage.(*fileStorage).wal
+	file := &tornFile{logFile: wal.file}
+	wal.file = file
+	return file
+}
+
+func TestTornLogEntryIsCutOff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	walFile(t, db).tear = true
+	_, err = db.CreateChirp("torn", "1")
+	if err == nil {
+		t.Fatal("creating a chirp with a failing log succeeded")
+	}
+	_, err = db.CreateChirp("after the torn one", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDB(path)
+	if err != nil {
+		t.Fatalf("the database doesn't reopen: %v", err)
+	}
+	defer db.Close()
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 1 || chirps[0].Body != "after the torn one" {
+		t.Fatalf("got chirps %v, want only the one after the torn entry", chirps)
+	}
+}
+
+func TestLogThatCantBeRepairedRefusesWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := walFile(t, db)
+	file.tear = true
+	file.truncateFails = true
+	_, err = db.CreateChirp("torn", "1")
+	if !errors.Is(err, errLogBroken) {
+		t.Fatalf("a failed write that couldn't be cut off returned %v, want %v", err, errLogBroken)
+	}
+	file.truncateFails = false
+	_, err = db.CreateChirp("after the torn one", "1")
+	if !errors.Is(err, errLogBroken) {
+		t.Fatalf("writing to a broken log returned %v, want %v", err, errLogBroken)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reopening cuts off the torn line
+	db, err = NewDB(path)
+	if err != nil {
+		t.Fatalf("the database doesn't reopen: %v", err)
+	}
+	defer db.Close()
+	_, err = db.CreateChirp("after reopening", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInvalidChangeIsNotLogged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.mux.Lock()
+	err = db.commit(setSequence("chirps", 5), change{Op: opPutChirp})
+	db.mux.Unlock()
+	if err == nil {
+		t.Fatal("a put_chirp without a chirp was committed")
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDB(path)
+	if err != nil {
+		t.Fatalf("the database doesn't reopen: %v", err)
+	}
+	defer db.Close()
+	chirp, err := db.CreateChirp("hello", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.Id != "1" {
+		t.Errorf("the first chirp got id %s, want 1: part of the invalid entry was kept", chirp.Id)
+	}
+}
+
+func TestCopyFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "database.json")
+	dst := filepath.Join(dir, "database.json.bak")
+	err := os.WriteFile(src, []byte("new"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(dst, []byte("old"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = copyFileAtomic(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "new" {
+		t.Errorf("the copy contains %q, want %q", data, "new")
+	}
+
+	err = copyFileAtomic(filepath.Join(dir, "missing.json"), dst)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("copying a missing file returned %v, want %v", err, os.ErrNotExist)
+	}
+}
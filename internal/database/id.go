@@ -0,0 +1,122 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// ID identifies a chirp or a user. IDs are opaque strings to clients;
+// what they look like depends on the IDGenerator the store was set up with.
+type ID string
+
+// UnmarshalJSON also accepts the plain numbers ids used to be
+func (id *ID) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] != '"' {
+		number := json.Number("")
+		err := json.Unmarshal(data, &number)
+		if err != nil {
+			return err
+		}
+		*id = ID(number)
+		return nil
+	}
+	value := ""
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+	*id = ID(value)
+	return nil
+}
+
+// Less orders ids by age: counter ids numerically, before any other kind,
+// and the rest (ULIDs) lexicographically, which for them is by time
+func (id ID) Less(other ID) bool {
+	a, aErr := strconv.ParseUint(string(id), 10, 64)
+	b, bErr := strconv.ParseUint(string(other), 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		return a < b
+	case aErr == nil:
+		return true
+	case bErr == nil:
+		return false
+	default:
+		return id < other
+	}
+}
+
+// Compare orders ids like Less, for slices.SortFunc
+func (id ID) Compare(other ID) int {
+	switch {
+	case id.Less(other):
+		return -1
+	case other.Less(id):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// IDGenerator hands out the ids of new records
+type IDGenerator interface {
+	// NewID returns a fresh id. seq is the next value of the persisted
+	// counter of the collection the record goes into; it never repeats,
+	// even after records are deleted.
+	NewID(seq uint64) (ID, error)
+}
+
+// CounterIDs uses the collection's counter as the id, giving 1, 2, 3...
+type CounterIDs struct{}
+
+func (CounterIDs) NewID(seq uint64) (ID, error) {
+	return ID(strconv.FormatUint(seq, 10)), nil
+}
+
+// ULIDs generates ULIDs (https://github.com/ulid/spec): 48 bits of
+// millisecond timestamp and 80 random bits, so they sort by creation time
+// and can't be guessed or used to count records.
+type ULIDs struct{}
+
+// crockford is the base32 alphabet ULIDs are written in
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func (ULIDs) NewID(seq uint64) (ID, error) {
+	data := [16]byte{}
+	binary.BigEndian.PutUint64(data[:8], uint64(time.Now().UnixMilli())<<16)
+	_, err := rand.Read(data[6:])
+	if err != nil {
+		return "", err
+	}
+
+	// 128 bits as 26 characters of 5 bits each, the first one only 3 bits
+	high := binary.BigEndian.Uint64(data[:8])
+	low := binary.BigEndian.Uint64(data[8:])
+	encoded := [26]byte{}
+	for i := 25; i >= 0; i-- {
+		encoded[i] = crockford[low&31]
+		low = low>>5 | high<<59
+		high >>= 5
+	}
+	return ID(encoded[:]), nil
+}
+
+const (
+	chirpSequence   = "chirps"
+	userSequence    = "users"
+	sessionSequence = "sessions"
+
+	personalTokenSequence = "personal_tokens"
+)
+
+// maxNumericId returns the larger of max and id if id is a counter id
+func maxNumericId(max uint64, id ID) uint64 {
+	n, err := strconv.ParseUint(string(id), 10, 64)
+	if err == nil && n > max {
+		return n
+	}
+	return max
+}
@@ -0,0 +1,62 @@
+package database
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestULIDsSortByCreation(t *testing.T) {
+	ids := []ID{}
+	for range 5 {
+		id, err := ULIDs{}.NewID(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(id) != 26 {
+			t.Fatalf("%s is %d characters long, want 26", id, len(id))
+		}
+		ids = append(ids, id)
+		// ULIDs of the same millisecond are in random order
+		time.Sleep(2 * time.Millisecond)
+	}
+	if !slices.IsSortedFunc(ids, func(a, b ID) int {
+		if a.Less(b) {
+			return -1
+		}
+		return 1
+	}) {
+		t.Errorf("ULIDs aren't in the order they were created: %v", ids)
+	}
+}
+
+func TestIDLess(t *testing.T) {
+	tests := []struct {
+		a, b ID
+		less bool
+	}{
+		{"2", "10", true},
+		{"10", "2", false},
+		{"10", "01ARZ3NDEKTSV4RRFFQ69G5FAV", true},
+		{"01ARZ3NDEKTSV4RRFFQ69G5FAV", "10", false},
+		{"01ARZ3NDEKTSV4RRFFQ69G5FAV", "01BX5ZZKBKACTAV9WEVGEMMVRZ", true},
+	}
+	for _, test := range tests {
+		if less := test.a.Less(test.b); less != test.less {
+			t.Errorf("%s.Less(%s) is %t, want %t", test.a, test.b, less, test.less)
+		}
+	}
+}
+
+func TestIDUnmarshalsNumbers(t *testing.T) {
+	ids := []ID{}
+	err := json.Unmarshal([]byte(`[7, "8", "01ARZ3NDEKTSV4RRFFQ69G5FAV"]`), &ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ID{"7", "8", "01ARZ3NDEKTSV4RRFFQ69G5FAV"}
+	if !slices.Equal(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+}
@@ -0,0 +1,148 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ImportJSON copies the users with their two-factor authentication,
+// chirps, sessions and personal access tokens of an existing database.json
+// into s, keeping their ids. It refuses to run against a database that
+// already has data so it can't be applied twice by accident.
+func (s *SQLiteDB) ImportJSON(path string, options ...Option) error {
+	file := newFileStorage(path, options...)
+	file.readOnly = true
+	dbStructure, err := file.readConsistent()
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	err = s.db.QueryRow("SELECT (SELECT COUNT(*) FROM users) + (SELECT COUNT(*) FROM chirps)").Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errors.New("the sqlite database is not empty")
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	seq := uint64(0)
+	for _, user := range sortedById(dbStructure.Users) {
+		seq = importedSeq(seq, user.Id)
+		_, err := tx.Exec(
+			"INSERT INTO users (seq, "+userColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			seq, user.Id, user.Email, user.Password, user.IsRedUser, strings.Join(user.Roles, " "),
+			importedTime(user.CreatedAt), importedTime(user.UpdatedAt),
+		)
+		if err != nil {
+			return err
+		}
+		if user.MFA != nil {
+			err := putSQLiteMFA(tx, user.Id, user.MFA)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = setImportedSequence(tx, userSequence, max(seq, dbStructure.Sequences[userSequence]))
+	if err != nil {
+		return err
+	}
+
+	seq = 0
+	for _, chirp := range sortedById(dbStructure.Chirps) {
+		seq = importedSeq(seq, chirp.Id)
+		deletedBy := sql.NullString{String: string(chirp.DeletedBy), Valid: chirp.IsDeleted()}
+		_, err := tx.Exec("INSERT INTO chirps (seq, "+chirpColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			seq, chirp.Id, chirp.Body, chirp.AuthorId, importedTime(chirp.CreatedAt), importedTime(chirp.UpdatedAt),
+			chirp.DeletedAt, deletedBy)
+		if err != nil {
+			return err
+		}
+	}
+	err = setImportedSequence(tx, chirpSequence, max(seq, dbStructure.Sequences[chirpSequence]))
+	if err != nil {
+		return err
+	}
+
+	seq = 0
+	for _, session := range sortedById(dbStructure.Sessions) {
+		seq = importedSeq(seq, session.Id)
+		_, err := tx.Exec("INSERT INTO sessions (seq, "+sessionColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			seq, session.Id, session.UserId, session.TokenHash, session.UserAgent, session.IP, strings.Join(session.Scopes, " "),
+			session.CreatedAt, session.LastUsedAt, session.ExpiresAt)
+		if err != nil {
+			return err
+		}
+		for i, hash := range session.RotatedHashes {
+			// only their order matters
+			rotatedAt := session.CreatedAt.Add(time.Duration(i))
+			_, err := tx.Exec("INSERT INTO session_rotated_tokens (token_hash, session_id, rotated_at) VALUES (?, ?, ?)",
+				hash, session.Id, rotatedAt)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = setImportedSequence(tx, sessionSequence, max(seq, dbStructure.Sequences[sessionSequence]))
+	if err != nil {
+		return err
+	}
+
+	seq = 0
+	for _, token := range sortedById(dbStructure.PersonalTokens) {
+		seq = importedSeq(seq, token.Id)
+		_, err := tx.Exec("INSERT INTO personal_tokens (seq, "+personalTokenColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			seq, token.Id, token.UserId, token.Name, token.TokenHash, strings.Join(token.Scopes, " "),
+			token.CreatedAt, token.LastUsedAt)
+		if err != nil {
+			return err
+		}
+	}
+	err = setImportedSequence(tx, personalTokenSequence, max(seq, dbStructure.Sequences[personalTokenSequence]))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// importedSeq gives the next record in id order a seq after prev, using
+// the id itself when it is a counter id so future counter ids don't clash
+func importedSeq(prev uint64, id ID) uint64 {
+	return max(prev+1, maxNumericId(0, id))
+}
+
+func setImportedSequence(tx *sql.Tx, name string, value uint64) error {
+	_, err := tx.Exec("UPDATE sequences SET value = ? WHERE name = ?", value, name)
+	return err
+}
+
+// importedTime stamps records from files older than timestamps with the
+// time of the import, like the JSON backend does when loading them
+func importedTime(t time.Time) time.Time {
+	if t.IsZero() {
+		return time.Now().UTC()
+	}
+	return t
+}
+
+// sortedById returns the records, which are filed under their ids, oldest
+// first so the imported sequences come out right
+func sortedById[T any](records map[ID]T) []T {
+	ids := slices.SortedFunc(maps.Keys(records), ID.Compare)
+	result := make([]T, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, records[id])
+	}
+	return result
+}
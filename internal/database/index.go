@@ -0,0 +1,158 @@
+package database
+
+import "strings"
+
+// indexes are lookup tables derived from a DBStructure. They aren't
+// persisted; openDB builds them and commit keeps them in step with every
+// change.
+type indexes struct {
+	usersByEmail        map[string]ID
+	chirpsByAuthor      map[ID]map[ID]struct{}
+	sessionsByTokenHash map[string]ID
+	sessionsByUser      map[ID]map[ID]struct{}
+
+	personalTokensByHash map[string]ID
+	personalTokensByUser map[ID]map[ID]struct{}
+}
+
+func newIndexes(dbStructure DBStructure) *indexes {
+	idx := &indexes{
+		usersByEmail:        map[string]ID{},
+		chirpsByAuthor:      map[ID]map[ID]struct{}{},
+		sessionsByTokenHash: map[string]ID{},
+		sessionsByUser:      map[ID]map[ID]struct{}{},
+
+		personalTokensByHash: map[string]ID{},
+		personalTokensByUser: map[ID]map[ID]struct{}{},
+	}
+	for _, user := range dbStructure.Users {
+		idx.addUser(user)
+	}
+	for _, chirp := range dbStructure.Chirps {
+		idx.addChirp(chirp)
+	}
+	for _, session := range dbStructure.Sessions {
+		idx.addSession(session)
+	}
+	for _, token := range dbStructure.PersonalTokens {
+		idx.addPersonalToken(token)
+	}
+	return idx
+}
+
+// update adjusts the indexes for c. It must run before c is applied,
+// while dbStructure still holds the records c replaces.
+func (idx *indexes) update(dbStructure DBStructure, c change) {
+	switch c.Op {
+	case opPutChirp:
+		if old, ok := dbStructure.Chirps[c.Chirp.Id]; ok {
+			idx.removeChirp(old)
+		}
+		idx.addChirp(*c.Chirp)
+	case opDeleteChirp:
+		if old, ok := dbStructure.Chirps[c.Id]; ok {
+			idx.removeChirp(old)
+		}
+	case opPutUser:
+		if old, ok := dbStructure.Users[c.User.Id]; ok {
+			idx.removeUser(old)
+		}
+		idx.addUser(*c.User)
+	case opDeleteUser:
+		if old, ok := dbStructure.Users[c.Id]; ok {
+			idx.removeUser(old)
+		}
+	case opPutSession:
+		if old, ok := dbStructure.Sessions[c.Session.Id]; ok {
+			idx.removeSession(old)
+		}
+		idx.addSession(*c.Session)
+	case opDeleteSession:
+		if old, ok := dbStructure.Sessions[c.Id]; ok {
+			idx.removeSession(old)
+		}
+	case opPutPersonalToken:
+		if old, ok := dbStructure.PersonalTokens[c.PersonalToken.Id]; ok {
+			idx.removePersonalToken(old)
+		}
+		idx.addPersonalToken(*c.PersonalToken)
+	case opDeletePersonalToken:
+		if old, ok := dbStructure.PersonalTokens[c.Id]; ok {
+			idx.removePersonalToken(old)
+		}
+	}
+}
+
+func (idx *indexes) addUser(user User) {
+	idx.usersByEmail[normalizeEmail(user.Email)] = user.Id
+}
+
+func (idx *indexes) removeUser(user User) {
+	delete(idx.usersByEmail, normalizeEmail(user.Email))
+}
+
+func (idx *indexes) addChirp(chirp Chirp) {
+	chirps, ok := idx.chirpsByAuthor[chirp.AuthorId]
+	if !ok {
+		chirps = map[ID]struct{}{}
+		idx.chirpsByAuthor[chirp.AuthorId] = chirps
+	}
+	chirps[chirp.Id] = struct{}{}
+}
+
+func (idx *indexes) removeChirp(chirp Chirp) {
+	chirps := idx.chirpsByAuthor[chirp.AuthorId]
+	delete(chirps, chirp.Id)
+	if len(chirps) == 0 {
+		delete(idx.chirpsByAuthor, chirp.AuthorId)
+	}
+}
+
+func (idx *indexes) addSession(session Session) {
+	idx.sessionsByTokenHash[session.TokenHash] = session.Id
+	for _, hash := range session.RotatedHashes {
+		idx.sessionsByTokenHash[hash] = session.Id
+	}
+	sessions, ok := idx.sessionsByUser[session.UserId]
+	if !ok {
+		sessions = map[ID]struct{}{}
+		idx.sessionsByUser[session.UserId] = sessions
+	}
+	sessions[session.Id] = struct{}{}
+}
+
+func (idx *indexes) removeSession(session Session) {
+	delete(idx.sessionsByTokenHash, session.TokenHash)
+	for _, hash := range session.RotatedHashes {
+		delete(idx.sessionsByTokenHash, hash)
+	}
+	sessions := idx.sessionsByUser[session.UserId]
+	delete(sessions, session.Id)
+	if len(sessions) == 0 {
+		delete(idx.sessionsByUser, session.UserId)
+	}
+}
+
+func (idx *indexes) addPersonalToken(token PersonalToken) {
+	idx.personalTokensByHash[token.TokenHash] = token.Id
+	tokens, ok := idx.personalTokensByUser[token.UserId]
+	if !ok {
+		tokens = map[ID]struct{}{}
+		idx.personalTokensByUser[token.UserId] = tokens
+	}
+	tokens[token.Id] = struct{}{}
+}
+
+func (idx *indexes) removePersonalToken(token PersonalToken) {
+	delete(idx.personalTokensByHash, token.TokenHash)
+	tokens := idx.personalTokensByUser[token.UserId]
+	delete(tokens, token.Id)
+	if len(tokens) == 0 {
+		delete(idx.personalTokensByUser, token.UserId)
+	}
+}
+
+// normalizeEmail gives the form emails are compared in
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package database
+
+import "os"
+
+// lockFile is a no-op where flock isn't available; running two
+// processes against the same database is not detected there
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+}
+
+func unlockFile(file *os.File) error {
+	return file.Close()
+}
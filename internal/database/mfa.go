@@ -0,0 +1,146 @@
+package database
+
+import (
+	"maps"
+	"slices"
+	"time"
+)
+
+// maxMFAFailures is how many wrong codes in a row lock a user's second
+// factor for mfaLockout, which keeps codes from being guessed
+const maxMFAFailures = 5
+
+const mfaLockout = 15 * time.Minute
+
+// MFA is a user's two-factor authentication with an authenticator app
+// (RFC 6238). Checking codes is up to the auth package; the database keeps
+// what makes them single use and counts the wrong ones. Recovery codes are
+// only stored as hashes.
+type MFA struct {
+	// Secret is the base32 encoded TOTP secret
+	Secret string `json:"secret"`
+	// EnabledAt is nil until the user confirms they enrolled the secret
+	EnabledAt *time.Time `json:"enabled_at"`
+	// LastStep is the time step of the last code that was accepted. Codes
+	// of it or earlier ones are refused so an observed code can't be
+	// replayed.
+	LastStep           int64      `json:"last_step"`
+	RecoveryCodeHashes []string   `json:"recovery_code_hashes"`
+	FailedAttempts     int        `json:"failed_attempts"`
+	LockedUntil        *time.Time `json:"locked_until,omitempty"`
+	// UsedChallenges are the jtis of the MFA tokens that were exchanged for
+	// a login, with when the tokens expire. They are dropped once expired.
+	UsedChallenges map[string]time.Time `json:"used_challenges,omitempty"`
+}
+
+// IsEnabled reports whether logging in requires a code
+func (m *MFA) IsEnabled() bool {
+	return m != nil && m.EnabledAt != nil
+}
+
+// IsLocked reports whether too many wrong codes were entered to accept
+// any at time now
+func (m *MFA) IsLocked(now time.Time) bool {
+	return m.LockedUntil != nil && now.Before(*m.LockedUntil)
+}
+
+// enable turns two-factor authentication on once the user has shown they
+// enrolled the secret with a code of time step step
+func (m *MFA) enable(step int64, recoveryCodeHashes []string, now time.Time) error {
+	if m.IsEnabled() {
+		return ErrMFAEnabled
+	}
+	m.EnabledAt = &now
+	m.LastStep = step
+	m.RecoveryCodeHashes = slices.Clone(recoveryCodeHashes)
+	return nil
+}
+
+// checkUsable returns why m can't accept a code at time now, if it can't
+func (m *MFA) checkUsable(now time.Time) error {
+	if !m.IsEnabled() {
+		return ErrMFANotEnrolled
+	}
+	if m.IsLocked(now) {
+		return ErrMFALocked
+	}
+	return nil
+}
+
+// useStep accepts a valid code of the authenticator from time step step,
+// unless a code of it or a later step was accepted already
+func (m *MFA) useStep(step int64, now time.Time) error {
+	err := m.checkUsable(now)
+	if err != nil {
+		return err
+	}
+	if step <= m.LastStep {
+		return ErrMFACodeReused
+	}
+	m.LastStep = step
+	m.FailedAttempts = 0
+	return nil
+}
+
+// useRecoveryCode accepts the recovery code with the hash and uses it up
+func (m *MFA) useRecoveryCode(hash string, now time.Time) error {
+	err := m.checkUsable(now)
+	if err != nil {
+		return err
+	}
+	i := slices.Index(m.RecoveryCodeHashes, hash)
+	if i < 0 {
+		return ErrMFACodeInvalid
+	}
+	m.RecoveryCodeHashes = slices.Delete(m.RecoveryCodeHashes, i, i+1)
+	m.FailedAttempts = 0
+	return nil
+}
+
+// useChallenge marks the MFA token with jti id, which expires at
+// expiresAt, as exchanged for a login, unless it was already
+func (m *MFA) useChallenge(id string, expiresAt time.Time, now time.Time) error {
+	err := m.checkUsable(now)
+	if err != nil {
+		return err
+	}
+	if _, used := m.UsedChallenges[id]; used {
+		return ErrMFAChallengeUsed
+	}
+	if m.UsedChallenges == nil {
+		m.UsedChallenges = map[string]time.Time{}
+	}
+	maps.DeleteFunc(m.UsedChallenges, func(_ string, expiresAt time.Time) bool {
+		return expiresAt.Before(now)
+	})
+	m.UsedChallenges[id] = expiresAt
+	return nil
+}
+
+// recordFailure counts a wrong code and locks m once there were
+// maxMFAFailures in a row
+func (m *MFA) recordFailure(now time.Time) error {
+	err := m.checkUsable(now)
+	if err != nil {
+		return err
+	}
+	m.FailedAttempts++
+	if m.FailedAttempts >= maxMFAFailures {
+		lockedUntil := now.Add(mfaLockout)
+		m.LockedUntil = &lockedUntil
+		m.FailedAttempts = 0
+	}
+	return nil
+}
+
+// clone returns a copy of m that can be changed without changing m, as m
+// may be a record of the database's state
+func (m *MFA) clone() *MFA {
+	if m == nil {
+		return nil
+	}
+	clone := *m
+	clone.RecoveryCodeHashes = slices.Clone(m.RecoveryCodeHashes)
+	clone.UsedChallenges = maps.Clone(m.UsedChallenges)
+	return &clone
+}
@@ -0,0 +1,191 @@
+package database
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the secret of the test vectors of RFC 6238
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestMFA(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := store.CreateUser("user@example.com", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.UseMFAStep(user.Id, 1)
+			if !errors.Is(err, ErrMFANotEnrolled) {
+				t.Fatalf("a code was checked before enrolling: %v", err)
+			}
+			_, err = store.EnrollMFA(user.Id, "SECRET")
+			if err != nil {
+				t.Fatal(err)
+			}
+			mfa, err := store.GetMFA(user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mfa.Secret != "SECRET" || mfa.IsEnabled() {
+				t.Fatalf("enrolling stored %+v", mfa)
+			}
+			err = store.UseMFAStep(user.Id, 1)
+			if !errors.Is(err, ErrMFANotEnrolled) {
+				t.Fatalf("a code was accepted before enabling: %v", err)
+			}
+
+			err = store.EnableMFA(user.Id, 10, []string{"a", "b"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.EnableMFA(user.Id, 11, nil)
+			if !errors.Is(err, ErrMFAEnabled) {
+				t.Errorf("enabling twice returned %v, want %v", err, ErrMFAEnabled)
+			}
+			_, err = store.EnrollMFA(user.Id, "OTHER")
+			if !errors.Is(err, ErrMFAEnabled) {
+				t.Errorf("enrolling again returned %v, want %v", err, ErrMFAEnabled)
+			}
+			_, err = store.LoginUser("user@example.com", "password", Device{}, nil)
+			if !errors.Is(err, ErrMFARequired) {
+				t.Errorf("logging in returned %v, want %v", err, ErrMFARequired)
+			}
+
+			steps := []struct {
+				name string
+				use  func() error
+				err  error
+			}{
+				{"the step of confirming", func() error { return store.UseMFAStep(user.Id, 10) }, ErrMFACodeReused},
+				{"a later step", func() error { return store.UseMFAStep(user.Id, 12) }, nil},
+				{"an earlier step", func() error { return store.UseMFAStep(user.Id, 11) }, ErrMFACodeReused},
+				{"a recovery code", func() error { return store.UseRecoveryCode(user.Id, "a") }, nil},
+				{"the recovery code again", func() error { return store.UseRecoveryCode(user.Id, "a") }, ErrMFACodeInvalid},
+				{"an unknown recovery code", func() error { return store.UseRecoveryCode(user.Id, "c") }, ErrMFACodeInvalid},
+			}
+			for _, step := range steps {
+				err := step.use()
+				if !errors.Is(err, step.err) {
+					t.Errorf("%s returned %v, want %v", step.name, err, step.err)
+				}
+			}
+			mfa, err = store.GetMFA(user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mfa.LastStep != 12 || len(mfa.RecoveryCodeHashes) != 1 {
+				t.Errorf("the last step is %d and %d recovery codes are left, want 12 and 1", mfa.LastStep, len(mfa.RecoveryCodeHashes))
+			}
+
+			for range maxMFAFailures {
+				err := store.RecordMFAFailure(user.Id)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, err := range []error{
+				store.RecordMFAFailure(user.Id),
+				store.UseMFAStep(user.Id, 13),
+				store.UseRecoveryCode(user.Id, "b"),
+			} {
+				if !errors.Is(err, ErrMFALocked) {
+					t.Errorf("after %d wrong codes got %v, want %v", maxMFAFailures, err, ErrMFALocked)
+				}
+			}
+
+			err = store.DisableMFA(user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.GetMFA(user.Id)
+			if !errors.Is(err, ErrMFANotEnrolled) {
+				t.Errorf("GetMFA after disabling returned %v, want %v", err, ErrMFANotEnrolled)
+			}
+		})
+	}
+}
+
+func TestMFAChallengesAreSingleUse(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := store.CreateUser("user@example.com", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.EnrollMFA(user.Id, "SECRET")
+			if err != nil {
+				t.Fatal(err)
+			}
+			expiresAt := time.Now().Add(time.Minute)
+			err = store.UseMFAChallenge(user.Id, "jti", expiresAt)
+			if !errors.Is(err, ErrMFANotEnrolled) {
+				t.Errorf("a challenge was used before enabling: %v", err)
+			}
+			err = store.EnableMFA(user.Id, 10, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			steps := []struct {
+				id        string
+				expiresAt time.Time
+				err       error
+			}{
+				{"expired", time.Now().Add(-time.Minute), nil},
+				{"jti", expiresAt, nil},
+				{"jti", expiresAt, ErrMFAChallengeUsed},
+				{"other", expiresAt, nil},
+			}
+			for _, step := range steps {
+				err := store.UseMFAChallenge(user.Id, step.id, step.expiresAt)
+				if !errors.Is(err, step.err) {
+					t.Errorf("using challenge %s returned %v, want %v", step.id, err, step.err)
+				}
+			}
+			mfa, err := store.GetMFA(user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := slices.Sorted(maps.Keys(mfa.UsedChallenges))
+			if !slices.Equal(ids, []string{"jti", "other"}) {
+				t.Errorf("the used challenges are %v, want jti and other without the expired one", ids)
+			}
+		})
+	}
+}
+
+func TestStartSessionChecksPasswordStamp(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := store.CreateUser("user@example.com", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			stamp := user.PasswordStamp()
+			if strings.Contains(user.Password, stamp) {
+				t.Error("the password stamp is part of the password hash")
+			}
+			login, err := store.StartSession(user.Id, stamp, Device{}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if login.User.Id != user.Id || len(login.RefreshToken) == 0 {
+				t.Errorf("started the session %+v for user %s", login.Session, login.User.Id)
+			}
+
+			_, err = store.UpdateUser(user.Id, user.Email, "new password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.StartSession(user.Id, stamp, Device{}, nil)
+			if !errors.Is(err, ErrPasswordChanged) {
+				t.Errorf("starting a session after the password changed returned %v, want %v", err, ErrPasswordChanged)
+			}
+		})
+	}
+}
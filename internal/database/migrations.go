@@ -0,0 +1,434 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// migrations upgrade database files written by older versions. They work
+// on the raw JSON rather than on DBStructure, so they keep working however
+// much DBStructure changes later. Migration i takes a file from schema
+// version i to i+1: existing entries must never be edited or reordered,
+// append a new one instead.
+var migrations = []migration{
+	{
+		description: "stamp records written before they had timestamps with the time of the migration",
+		apply:       stampTimestamps,
+	},
+	{
+		description: "store ids as strings and start the id sequences after the highest id in use",
+		apply:       stringIds,
+	},
+	{
+		description: "move refresh tokens from users into sessions that only keep their hash",
+		apply:       refreshTokenSessions,
+	},
+	{
+		description: "grant every scope to sessions started before access tokens had scopes",
+		apply:       sessionScopes,
+	},
+	{
+		description: "add the collection and sequence of personal access tokens",
+		apply:       personalTokens,
+	},
+	{
+		description: "let users have two-factor authentication",
+		apply:       userMFA,
+	},
+	{
+		description: "grant account:read to sessions and tokens that can change the account",
+		apply:       accountReadScope,
+	},
+	{
+		description: "let two-factor authentication remember the MFA tokens that were used",
+		apply:       usedMFAChallenges,
+	},
+}
+
+// currentSchemaVersion is the schema version of files written by this build
+var currentSchemaVersion = len(migrations)
+
+type migration struct {
+	description string
+	apply       func(doc rawDB) error
+}
+
+// rawDB is a database file decoded without a schema. Numbers are kept as
+// json.Number so ids survive unchanged.
+type rawDB map[string]any
+
+func parseRawDB(data []byte) (rawDB, error) {
+	if len(data) == 0 {
+		return nil, errors.New("the file is empty")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	doc := rawDB{}
+	err := decoder.Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// schemaVersion returns the version the file was written in; files from
+// before versioning have none and count as version 0
+func (doc rawDB) schemaVersion() (int, error) {
+	value, ok := doc["schema_version"]
+	if !ok {
+		return 0, nil
+	}
+	number, ok := value.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("schema_version %v is not a number", value)
+	}
+	version, err := number.Int64()
+	if err != nil {
+		return 0, fmt.Errorf("schema_version %v is not a whole number", value)
+	}
+	return int(version), nil
+}
+
+// pendingMigrations returns the migrations that still have to run on doc
+func (doc rawDB) pendingMigrations() ([]migration, error) {
+	version, err := doc.schemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version > currentSchemaVersion {
+		return nil, fmt.Errorf("database schema version %d is newer than this build supports (%d)", version, currentSchemaVersion)
+	}
+	return migrations[version:], nil
+}
+
+// migrate brings doc up to currentSchemaVersion
+func (doc rawDB) migrate() error {
+	pending, err := doc.pendingMigrations()
+	if err != nil {
+		return err
+	}
+	version := currentSchemaVersion - len(pending)
+	for _, m := range pending {
+		err := m.apply(doc)
+		if err != nil {
+			return fmt.Errorf("migration to schema version %d: %w", version+1, err)
+		}
+		version++
+		doc["schema_version"] = json.Number(fmt.Sprint(version))
+	}
+	return nil
+}
+
+// decode converts an up to date doc into a DBStructure
+func (doc rawDB) decode() (DBStructure, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return DBStructure{}, err
+	}
+	dbStructure := DBStructure{}
+	err = json.Unmarshal(data, &dbStructure)
+	if err != nil {
+		return DBStructure{}, err
+	}
+	if dbStructure.Chirps == nil {
+		dbStructure.Chirps = map[ID]Chirp{}
+	}
+	if dbStructure.Users == nil {
+		dbStructure.Users = map[ID]User{}
+	}
+	if dbStructure.Sessions == nil {
+		dbStructure.Sessions = map[ID]Session{}
+	}
+	if dbStructure.PersonalTokens == nil {
+		dbStructure.PersonalTokens = map[ID]PersonalToken{}
+	}
+	if dbStructure.Sequences == nil {
+		dbStructure.Sequences = map[string]uint64{}
+	}
+	return dbStructure, nil
+}
+
+// collection returns the records stored under name, creating the map if
+// the file doesn't have it
+func (doc rawDB) collection(name string) (map[string]any, error) {
+	value, ok := doc[name]
+	if !ok || value == nil {
+		records := map[string]any{}
+		doc[name] = records
+		return records, nil
+	}
+	records, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an object", name)
+	}
+	return records, nil
+}
+
+// records calls fn with each record of the collection
+func (doc rawDB) records(name string, fn func(record map[string]any) error) error {
+	records, err := doc.collection(name)
+	if err != nil {
+		return err
+	}
+	for key, value := range records {
+		record, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s %s is not an object", name, key)
+		}
+		err := fn(record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyEntry performs a write-ahead log entry on doc. Every change carries
+// the whole record, so this works for entries of any schema version.
+func (doc rawDB) applyEntry(line []byte) error {
+	entry := struct {
+		Changes []map[string]any `json:"changes"`
+	}{}
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	err := decoder.Decode(&entry)
+	if err != nil {
+		return err
+	}
+	for _, c := range entry.Changes {
+		err := doc.applyChange(c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (doc rawDB) applyChange(c map[string]any) error {
+	collections := map[string]string{
+		opPutChirp:      "chirps",
+		opDeleteChirp:   "chirps",
+		opPutUser:       "users",
+		opDeleteUser:    "users",
+		opPutSession:    "sessions",
+		opDeleteSession: "sessions",
+
+		opPutPersonalToken:    "personal_tokens",
+		opDeletePersonalToken: "personal_tokens",
+	}
+	fields := map[string]string{
+		opPutChirp:         "chirp",
+		opPutUser:          "user",
+		opPutSession:       "session",
+		opPutPersonalToken: "personal_token",
+	}
+	op, _ := c["op"].(string)
+	switch op {
+	case opPutChirp, opPutUser, opPutSession, opPutPersonalToken:
+		field := fields[op]
+		record, ok := c[field].(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s without a %s", op, field)
+		}
+		records, err := doc.collection(collections[op])
+		if err != nil {
+			return err
+		}
+		records[fmt.Sprint(record["id"])] = record
+	case opDeleteChirp, opDeleteUser, opDeleteSession, opDeletePersonalToken:
+		records, err := doc.collection(collections[op])
+		if err != nil {
+			return err
+		}
+		delete(records, fmt.Sprint(c["id"]))
+	case opSetSequence:
+		sequences, err := doc.collection("sequences")
+		if err != nil {
+			return err
+		}
+		value, ok := c["value"]
+		if !ok {
+			value = json.Number("0")
+		}
+		sequences[fmt.Sprint(c["sequence"])] = value
+	default:
+		return fmt.Errorf("unknown operation %q", op)
+	}
+	return nil
+}
+
+// stampTimestamps is migration 1
+func stampTimestamps(doc rawDB) error {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	stamp := func(record map[string]any) error {
+		if !isZeroTime(record["created_at"]) {
+			return nil
+		}
+		record["created_at"] = now
+		record["updated_at"] = now
+		return nil
+	}
+	err := doc.records("chirps", stamp)
+	if err != nil {
+		return err
+	}
+	return doc.records("users", stamp)
+}
+
+func isZeroTime(value any) bool {
+	s, ok := value.(string)
+	if !ok {
+		return true
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	return err != nil || t.IsZero()
+}
+
+// stringIds is migration 2
+func stringIds(doc rawDB) error {
+	sequences, err := doc.collection("sequences")
+	if err != nil {
+		return err
+	}
+	for name, fields := range map[string][]string{
+		chirpSequence: {"id", "author_id", "deleted_by"},
+		userSequence:  {"id"},
+	} {
+		max := uint64(0)
+		err := doc.records(name, func(record map[string]any) error {
+			for _, field := range fields {
+				if number, ok := record[field].(json.Number); ok {
+					record[field] = number.String()
+				}
+			}
+			if id, ok := record["id"].(string); ok {
+				max = maxNumericId(max, ID(id))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if _, ok := sequences[name]; !ok {
+			sequences[name] = json.Number(fmt.Sprint(max))
+		}
+	}
+	return nil
+}
+
+// refreshTokenSessions is migration 3
+func refreshTokenSessions(doc rawDB) error {
+	sessions, err := doc.collection("sessions")
+	if err != nil {
+		return err
+	}
+	sequences, err := doc.collection("sequences")
+	if err != nil {
+		return err
+	}
+	seq := uint64(0)
+	if value, ok := sequences[sessionSequence].(json.Number); ok {
+		seq, err = strconv.ParseUint(value.String(), 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	err = doc.records("users", func(user map[string]any) error {
+		token, _ := user["refresh_token"].(string)
+		expiresAt := user["expiration_time"]
+		delete(user, "refresh_token")
+		delete(user, "expiration_time")
+		if len(token) == 0 {
+			return nil
+		}
+		seq++
+		id := strconv.FormatUint(seq, 10)
+		sessions[id] = map[string]any{
+			"created_at":   now,
+			"last_used_at": now,
+			"expires_at":   expiresAt,
+			"token_hash":   hashToken(token),
+			"user_agent":   "",
+			"id":           id,
+			"user_id":      user["id"],
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sequences[sessionSequence] = json.Number(strconv.FormatUint(seq, 10))
+	return nil
+}
+
+// sessionScopes is migration 4
+func sessionScopes(doc rawDB) error {
+	// every scope there was when scopes were introduced
+	scopes := []any{"account:write", "admin", "chirps:read", "chirps:write"}
+	return doc.records("sessions", func(session map[string]any) error {
+		if _, ok := session["scopes"]; !ok {
+			session["scopes"] = scopes
+		}
+		return nil
+	})
+}
+
+// personalTokens is migration 5
+func personalTokens(doc rawDB) error {
+	_, err := doc.collection("personal_tokens")
+	if err != nil {
+		return err
+	}
+	sequences, err := doc.collection("sequences")
+	if err != nil {
+		return err
+	}
+	if _, ok := sequences[personalTokenSequence]; !ok {
+		sequences[personalTokenSequence] = json.Number("0")
+	}
+	return nil
+}
+
+// userMFA is migration 6. Users only gain an optional field, so no record
+// changes; the new version keeps older builds, which would drop the field
+// when they save a user, from opening the file.
+func userMFA(doc rawDB) error {
+	return nil
+}
+
+// accountReadScope is migration 7
+func accountReadScope(doc rawDB) error {
+	grant := func(record map[string]any) error {
+		value, ok := record["scopes"]
+		if !ok || value == nil {
+			return nil
+		}
+		scopes, ok := value.([]any)
+		if !ok {
+			return fmt.Errorf("the scopes of %v are not a list", record["id"])
+		}
+		if slices.Contains(scopes, any("account:write")) && !slices.Contains(scopes, any("account:read")) {
+			// account:read sorts first
+			scopes = append([]any{"account:read"}, scopes...)
+		}
+		record["scopes"] = scopes
+		return nil
+	}
+	err := doc.records("sessions", grant)
+	if err != nil {
+		return err
+	}
+	return doc.records("personal_tokens", grant)
+}
+
+// usedMFAChallenges is migration 8. Like userMFA it only adds an optional
+// field, which older builds would drop.
+func usedMFAChallenges(doc rawDB) error {
+	return nil
+}
@@ -0,0 +1,285 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The fixtures in testdata hold the same records the way each schema
+// version stored them:
+//   - users 1 (a@example.com) and 2 (b@example.com, Chirpy Red), both with
+//     the password "password"
+//   - chirps 1 and 2, and chirp 3 in the trash once chirps could be deleted
+//   - the refresh token "legacy-refresh-token" of user 1, on the user and
+//     later on a session of theirs, which has scopes once sessions had them
+//   - a personal access token of user 1, "chirpy_pat_fixture", once there
+//     were personal access tokens
+//   - an unconfirmed authenticator of user 2 with the secret rfc6238Secret,
+//     once there was two-factor authentication
+//   - the scopes account:write, which brings account:read along, and
+//     chirps:read, once sessions and tokens had scopes
+
+// fixtureTime is when the records of the fixtures were created, in the
+// versions that recorded it
+var fixtureTime = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// allScopes are the scopes sessions from before scopes end up with
+var allScopes = []string{"account:read", "account:write", "admin", "chirps:read", "chirps:write"}
+
+// limitedScopes are the scopes the session of the fixtures with scopes
+// ends up with, once account:write brought account:read along
+var limitedScopes = []string{"account:read", "account:write", "chirps:read", "chirps:write"}
+
+// fixture is what a fixture of some schema version holds
+type fixture struct {
+	// timestamps is set if the version recorded when records were created
+	timestamps bool
+	// deletedChirp is set if the fixture has chirp 3 in the trash
+	deletedChirp bool
+	// scopes are the scopes the session of user 1 has after migrating
+	scopes []string
+	// personalToken is set if user 1 has a personal access token
+	personalToken bool
+	// mfaEnrolled is set if user 2 started enrolling an authenticator
+	mfaEnrolled bool
+}
+
+// checkMigrated checks that store holds the records of the fixtures and
+// that new ones continue their sequences
+func checkMigrated(t *testing.T, store Store, want fixture) {
+	t.Helper()
+	refreshed, err := store.RotateRefreshToken("legacy-refresh-token", Device{})
+	if err != nil {
+		t.Fatalf("the refresh token wasn't accepted: %v", err)
+	}
+	user := refreshed.User
+	if user.Id != "1" || user.Email != "a@example.com" {
+		t.Errorf("the refresh token is of user %q (%s), want 1", user.Id, user.Email)
+	}
+	if want.timestamps && !user.CreatedAt.Equal(fixtureTime) {
+		t.Errorf("user 1 was created at %s, want %s", user.CreatedAt, fixtureTime)
+	}
+	if !want.timestamps && (user.CreatedAt.IsZero() || time.Since(user.CreatedAt) > time.Minute) {
+		t.Errorf("user 1 was created at %s, want the time of the migration", user.CreatedAt)
+	}
+	if !slices.Equal(refreshed.Session.Scopes, want.scopes) {
+		t.Errorf("the session has scopes %v, want %v", refreshed.Session.Scopes, want.scopes)
+	}
+	other, err := store.LoginUser("b@example.com", "password", Device{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.User.Id != "2" || !other.User.IsRedUser {
+		t.Errorf("b@example.com is user %s, Chirpy Red %t", other.User.Id, other.User.IsRedUser)
+	}
+	if want.mfaEnrolled {
+		mfa, err := store.GetMFA("2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mfa.Secret != rfc6238Secret || mfa.IsEnabled() {
+			t.Errorf("user 2 has two-factor authentication %+v, want an unconfirmed %s", mfa, rfc6238Secret)
+		}
+	}
+
+	chirps, err := store.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []ID{}
+	for _, chirp := range chirps {
+		ids = append(ids, chirp.Id)
+	}
+	if !slices.Equal(ids, []ID{"1", "2"}) {
+		t.Fatalf("got chirps %v, want 1 and 2", ids)
+	}
+	if chirps[0].AuthorId != "1" || chirps[1].AuthorId != "2" {
+		t.Errorf("the chirps are by %s and %s, want 1 and 2", chirps[0].AuthorId, chirps[1].AuthorId)
+	}
+	if want.deletedChirp {
+		_, err := store.GetSingleChirp("3")
+		if !errors.Is(err, ErrChirpDeleted) {
+			t.Errorf("chirp 3 returned %v, want %v", err, ErrChirpDeleted)
+		}
+	}
+
+	if want.personalToken {
+		token, err := store.UsePersonalToken("chirpy_pat_fixture")
+		if err != nil {
+			t.Fatalf("the personal access token wasn't accepted: %v", err)
+		}
+		if token.UserId != "1" {
+			t.Errorf("the personal access token is of user %s, want 1", token.UserId)
+		}
+		if !slices.Equal(token.Scopes, []string{"chirps:read", "chirps:write"}) {
+			t.Errorf("the personal access token has scopes %v, want chirps:read and chirps:write", token.Scopes)
+		}
+	}
+
+	chirp, err := store.CreateChirp("new", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantId := ID("3")
+	if want.deletedChirp {
+		wantId = "4"
+	}
+	if chirp.Id != wantId {
+		t.Errorf("a new chirp got id %s, want %s", chirp.Id, wantId)
+	}
+	created, err := store.CreateUser("c@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Id != "3" {
+		t.Errorf("a new user got id %s, want 3", created.Id)
+	}
+}
+
+// jsonFixtures are what the JSON fixture of each schema version holds
+var jsonFixtures = []fixture{
+	{timestamps: false, deletedChirp: false, scopes: allScopes},
+	{timestamps: true, deletedChirp: true, scopes: allScopes},
+	{timestamps: true, deletedChirp: true, scopes: allScopes},
+	{timestamps: true, deletedChirp: true, scopes: allScopes},
+	{timestamps: true, deletedChirp: true, scopes: limitedScopes},
+	{timestamps: true, deletedChirp: true, scopes: limitedScopes, personalToken: true},
+	{timestamps: true, deletedChirp: true, scopes: limitedScopes, personalToken: true, mfaEnrolled: true},
+	{timestamps: true, deletedChirp: true, scopes: limitedScopes, personalToken: true, mfaEnrolled: true},
+	{timestamps: true, deletedChirp: true, scopes: limitedScopes, personalToken: true, mfaEnrolled: true},
+}
+
+// copyFixture copies a fixture from testdata to a new database file
+func copyFixture(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "database.json")
+	err = os.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestJSONFixtureForEveryVersion(t *testing.T) {
+	if len(jsonFixtures) != currentSchemaVersion+1 {
+		t.Fatalf("there are fixtures for %d versions, want one for each of the %d", len(jsonFixtures), currentSchemaVersion+1)
+	}
+}
+
+func TestMigrateJSON(t *testing.T) {
+	for version, want := range jsonFixtures {
+		t.Run(fmt.Sprintf("version %d", version), func(t *testing.T) {
+			path := copyFixture(t, fmt.Sprintf("json-v%d.json", version))
+			pending, err := PendingMigrations(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pending) != currentSchemaVersion-version {
+				t.Errorf("%d migrations are pending, want %d", len(pending), currentSchemaVersion-version)
+			}
+
+			db, err := NewDB(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			checkMigrated(t, db, want)
+
+			doc, _, err := readDBFile(path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			written, err := doc.schemaVersion()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written != currentSchemaVersion {
+				t.Errorf("the file was left at schema version %d, want %d", written, currentSchemaVersion)
+			}
+		})
+	}
+}
+
+func TestMigrateJSONDryRun(t *testing.T) {
+	path := copyFixture(t, "json-v0.json")
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := PendingMigrations(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != currentSchemaVersion {
+		t.Errorf("%d migrations are pending, want %d", len(pending), currentSchemaVersion)
+	}
+	// the migrate command's dry run migrates in a read-only database
+	db, err := NewReadOnlyDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 2 || chirps[0].AuthorId != "1" {
+		t.Errorf("got chirps %v, want 1 and 2", chirps)
+	}
+	db.Close()
+
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("the dry run changed the file")
+	}
+	entries, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) > 0 {
+		t.Errorf("the dry run created %v", entries)
+	}
+}
+
+func TestMigrateJSONFromNewerVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	data := fmt.Sprintf(`{"schema_version": %d, "chirps": {}, "users": {}}`, currentSchemaVersion+1)
+	err := os.WriteFile(path, []byte(data), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = PendingMigrations(path)
+	if err == nil || !strings.Contains(err.Error(), "newer than this build") {
+		t.Errorf("PendingMigrations returned %v, want a newer version error", err)
+	}
+	db, err := NewDB(path)
+	if err == nil {
+		db.Close()
+		t.Fatal("a file from a newer version was opened")
+	}
+	if !strings.Contains(err.Error(), "newer than this build") {
+		t.Errorf("NewDB returned %v, want a newer version error", err)
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != data {
+		t.Error("the file from a newer version was changed")
+	}
+}
@@ -0,0 +1,63 @@
+package database
+
+import (
+	"strings"
+	"time"
+)
+
+// PersonalTokenPrefix starts every personal access token, which tells them
+// apart from JWTs and lets secret scanners recognise leaked ones
+const PersonalTokenPrefix = "chirpy_pat_"
+
+// personalTokenUseResolution is how often a personal access token's
+// LastUsedAt is updated, so bots calling the API all the time don't cause
+// a write on every request
+const personalTokenUseResolution = time.Minute
+
+// PersonalToken is a long-lived credential a user creates for scripts and
+// bots, limited to some scopes. Like refresh tokens it is only stored as a
+// hash and stays valid until it is revoked.
+type PersonalToken struct {
+	CreatedAt time.Time `json:"created_at"`
+	// LastUsedAt is nil for tokens that were never used
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Name       string     `json:"name"`
+	TokenHash  string     `json:"token_hash"`
+	Scopes     []string   `json:"scopes"`
+	Id         ID         `json:"id"`
+	UserId     ID         `json:"user_id"`
+}
+
+// IsPersonalToken reports whether a bearer token is a personal access
+// token rather than a JWT
+func IsPersonalToken(token string) bool {
+	return strings.HasPrefix(token, PersonalTokenPrefix)
+}
+
+// newPersonalToken creates a personal access token for the user and
+// returns it together with the token itself, which is not kept anywhere
+func newPersonalToken(userId ID, name string, scopes []string) (PersonalToken, string, error) {
+	secret, err := newRefreshToken()
+	if err != nil {
+		return PersonalToken{}, "", err
+	}
+	token := PersonalTokenPrefix + secret
+	return PersonalToken{
+		CreatedAt: time.Now().UTC(),
+		Name:      name,
+		TokenHash: hashToken(token),
+		Scopes:    scopes,
+		UserId:    userId,
+	}, token, nil
+}
+
+// use records that the token is being used now. It reports whether that
+// changed LastUsedAt enough to be worth saving.
+func (token *PersonalToken) use() bool {
+	now := time.Now().UTC()
+	if token.LastUsedAt != nil && now.Sub(*token.LastUsedAt) < personalTokenUseResolution {
+		return false
+	}
+	token.LastUsedAt = &now
+	return true
+}
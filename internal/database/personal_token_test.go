@@ -0,0 +1,74 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPersonalTokens(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := store.CreateUser("a@example.com", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			created, secret, err := store.CreatePersonalToken(user.Id, "script", []string{"chirps:write"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !IsPersonalToken(secret) {
+				t.Errorf("the token %q doesn't start with %s", secret, PersonalTokenPrefix)
+			}
+			if strings.Contains(created.TokenHash, strings.TrimPrefix(secret, PersonalTokenPrefix)) {
+				t.Error("the token is stored as is")
+			}
+			if created.LastUsedAt != nil {
+				t.Errorf("a new token was last used at %s", created.LastUsedAt)
+			}
+
+			used, err := store.UsePersonalToken(secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if used.Id != created.Id || used.UserId != user.Id || !slices.Equal(used.Scopes, []string{"chirps:write"}) {
+				t.Errorf("using the token returned %+v, want %+v", used, created)
+			}
+			if used.LastUsedAt == nil {
+				t.Fatal("using the token didn't record when")
+			}
+			again, err := store.UsePersonalToken(secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again.LastUsedAt == nil || !again.LastUsedAt.Equal(*used.LastUsedAt) {
+				t.Errorf("using the token again within %s moved last_used_at to %v", personalTokenUseResolution, again.LastUsedAt)
+			}
+			tokens, err := store.GetPersonalTokens(user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tokens) != 1 || tokens[0].LastUsedAt == nil {
+				t.Fatalf("got tokens %+v, want the used one", tokens)
+			}
+
+			_, err = store.UsePersonalToken(PersonalTokenPrefix + "unknown")
+			if !errors.Is(err, ErrPersonalTokenInvalid) {
+				t.Errorf("an unknown token returned %v, want %v", err, ErrPersonalTokenInvalid)
+			}
+			err = store.DeletePersonalToken(created.Id, "2")
+			if !errors.Is(err, ErrPersonalTokenNotFound) {
+				t.Errorf("deleting another user's token returned %v, want %v", err, ErrPersonalTokenNotFound)
+			}
+			err = store.DeletePersonalToken(created.Id, user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.UsePersonalToken(secret)
+			if !errors.Is(err, ErrPersonalTokenInvalid) {
+				t.Errorf("a deleted token returned %v, want %v", err, ErrPersonalTokenInvalid)
+			}
+		})
+	}
+}
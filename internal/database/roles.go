@@ -0,0 +1,40 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// The roles a user can be granted
+const (
+	// RoleAdmin may use the admin endpoints
+	RoleAdmin = "admin"
+	// RoleModerator may delete and restore anyone's chirps
+	RoleModerator = "moderator"
+)
+
+// Roles lists every role there is
+var Roles = []string{RoleAdmin, RoleModerator}
+
+// ErrUnknownRole is returned when granting a role that doesn't exist
+var ErrUnknownRole = errors.New("unknown role")
+
+// HasRole reports whether the user was granted role
+func (user User) HasRole(role string) bool {
+	return slices.Contains(user.Roles, role)
+}
+
+// normalizeRoles checks that roles exist and returns them sorted and
+// without duplicates
+func normalizeRoles(roles []string) ([]string, error) {
+	normalized := []string{}
+	for _, role := range roles {
+		if !slices.Contains(Roles, role) {
+			return nil, fmt.Errorf("%w %q", ErrUnknownRole, role)
+		}
+		normalized = append(normalized, role)
+	}
+	slices.Sort(normalized)
+	return slices.Compact(normalized), nil
+}
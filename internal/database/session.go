@@ -0,0 +1,117 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"time"
+)
+
+// refreshTokenLifetimeDays is how long a session lasts after login. Rotating
+// its refresh token doesn't extend it.
+const refreshTokenLifetimeDays = 60
+
+// keepRotatedHashes is how many of its previous refresh tokens a session
+// remembers to detect their reuse
+const keepRotatedHashes = 100
+
+// Session is a login of a user on one device. The refresh token that
+// identifies it is only stored as a hash, so a leaked database can't be
+// used to log in.
+//
+// The refresh token is replaced every time it is used. The tokens it
+// replaced form the session's token family: seeing one of them again means
+// a token was stolen, and the whole session is revoked.
+type Session struct {
+	CreatedAt     time.Time `json:"created_at"`
+	LastUsedAt    time.Time `json:"last_used_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	TokenHash     string    `json:"token_hash"`
+	RotatedHashes []string  `json:"rotated_hashes,omitempty"`
+	UserAgent     string    `json:"user_agent"`
+	IP            string    `json:"ip"`
+	// Scopes are the scopes the session's access tokens were asked for
+	Scopes []string `json:"scopes"`
+	Id     ID       `json:"id"`
+	UserId ID       `json:"user_id"`
+}
+
+// Login is a session that was just started or refreshed, together with
+// its user and its new refresh token, which is not kept anywhere
+type Login struct {
+	User         User
+	Session      Session
+	RefreshToken string
+}
+
+// Device describes where a session is used from
+type Device struct {
+	UserAgent string
+	IP        string
+}
+
+// rotate replaces the session's refresh token with a new one, which it
+// returns, and records that it was used from ip
+func (session *Session) rotate(ip string) (string, error) {
+	token, err := newRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	session.RotatedHashes = append(session.RotatedHashes, session.TokenHash)
+	if len(session.RotatedHashes) > keepRotatedHashes {
+		session.RotatedHashes = session.RotatedHashes[len(session.RotatedHashes)-keepRotatedHashes:]
+	}
+	session.TokenHash = hashToken(token)
+	session.LastUsedAt = time.Now().UTC()
+	session.IP = ip
+	return token, nil
+}
+
+// hasTokenHash reports whether hash is of the session's token family
+func (session Session) hasTokenHash(hash string) bool {
+	return session.TokenHash == hash || slices.Contains(session.RotatedHashes, hash)
+}
+
+// IsExpired reports whether the session can no longer be refreshed
+func (session Session) IsExpired() bool {
+	return time.Now().After(session.ExpiresAt)
+}
+
+// newSession starts a session for the user and returns it together with
+// its refresh token, which is not kept anywhere
+func newSession(userId ID, device Device, scopes []string) (Session, string, error) {
+	token, err := newRefreshToken()
+	if err != nil {
+		return Session{}, "", err
+	}
+	now := time.Now().UTC()
+	return Session{
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.AddDate(0, 0, refreshTokenLifetimeDays),
+		TokenHash:  hashToken(token),
+		UserAgent:  device.UserAgent,
+		IP:         device.IP,
+		Scopes:     scopes,
+		UserId:     userId,
+	}, token, nil
+}
+
+func newRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken gives the form refresh tokens are stored and looked up in.
+// Tokens are hex, which clients have always been allowed to send in
+// either case.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(token)))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,204 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSessionPerLogin(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := store.CreateUser("user@example.com", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.LoginUser("user@example.com", "wrong", Device{UserAgent: "phone"}, nil)
+			if err == nil {
+				t.Fatal("a wrong password was accepted")
+			}
+			phone, err := store.LoginUser("user@example.com", "password", Device{UserAgent: "phone"}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			laptop, err := store.LoginUser("user@example.com", "password", Device{UserAgent: "laptop"}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if phone.RefreshToken == laptop.RefreshToken {
+				t.Fatal("two logins got the same refresh token")
+			}
+			// tokens are hex, which clients may send in either case
+			tokens := []string{}
+			for _, token := range []string{phone.RefreshToken, strings.ToUpper(laptop.RefreshToken)} {
+				rotated, err := store.RotateRefreshToken(token, Device{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rotated.User.Id != user.Id {
+					t.Errorf("the refresh token is of user %q, want %s", rotated.User.Id, user.Id)
+				}
+				tokens = append(tokens, rotated.RefreshToken)
+			}
+
+			// logging out on one device leaves the other logged in
+			err = store.RevokeRefreshToken(tokens[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.RotateRefreshToken(tokens[0], Device{})
+			if !errors.Is(err, ErrRefreshTokenInvalid) {
+				t.Errorf("the revoked refresh token returned %v, want %v", err, ErrRefreshTokenInvalid)
+			}
+			found, err := store.RotateRefreshToken(tokens[1], Device{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found.User.Id != user.Id {
+				t.Errorf("the other device's refresh token is of user %q, want %s", found.User.Id, user.Id)
+			}
+		})
+	}
+}
+
+func TestSessionsOnlyKeepTokenHashes(t *testing.T) {
+	db := NewMemoryDB()
+	user, err := db.CreateUser("user@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	login, err := db.LoginUser("user@example.com", "password", Device{UserAgent: "phone"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.View(func(tx *Tx) error {
+		sessions := tx.SessionsByUser(user.Id)
+		if len(sessions) != 1 {
+			t.Fatalf("the user has %d sessions, want 1", len(sessions))
+		}
+		if sessions[0].TokenHash != hashToken(login.RefreshToken) {
+			t.Errorf("the session keeps %q, want the hash of the refresh token", sessions[0].TokenHash)
+		}
+		if sessions[0].UserAgent != "phone" {
+			t.Errorf("the session is of %q, want phone", sessions[0].UserAgent)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestLogin creates a user in a new in-memory database and logs them in
+func newTestLogin(t *testing.T) (*DB, Login) {
+	t.Helper()
+	db := NewMemoryDB()
+	_, err := db.CreateUser("user@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	login, err := db.LoginUser("user@example.com", "password", Device{UserAgent: "test", IP: "192.0.2.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, login
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	db, login := newTestLogin(t)
+	rotated, err := db.RotateRefreshToken(login.RefreshToken, Device{IP: "192.0.2.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.RefreshToken == login.RefreshToken {
+		t.Fatal("the refresh token wasn't replaced")
+	}
+	if rotated.Session.Id != login.Session.Id {
+		t.Errorf("rotating moved to session %s, want %s", rotated.Session.Id, login.Session.Id)
+	}
+	if rotated.Session.IP != "192.0.2.2" {
+		t.Errorf("the session's IP is %s, want the one it was rotated from", rotated.Session.IP)
+	}
+	if !rotated.Session.ExpiresAt.Equal(login.Session.ExpiresAt) {
+		t.Errorf("rotating extended the session to %s", rotated.Session.ExpiresAt)
+	}
+
+	again, err := db.RotateRefreshToken(rotated.RefreshToken, Device{})
+	if err != nil {
+		t.Fatalf("the new refresh token wasn't accepted: %v", err)
+	}
+	if again.RefreshToken == rotated.RefreshToken {
+		t.Fatal("the refresh token wasn't replaced the second time")
+	}
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	db, login := newTestLogin(t)
+	rotated, err := db.RotateRefreshToken(login.RefreshToken, Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// someone replays the token that was already exchanged
+	_, err = db.RotateRefreshToken(login.RefreshToken, Device{})
+	if !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("reusing a token returned %v, want %v", err, ErrRefreshTokenReused)
+	}
+	// which ends the session for the legitimate holder of the newest one too
+	_, err = db.RotateRefreshToken(rotated.RefreshToken, Device{})
+	if !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Fatalf("the newest token of a revoked session returned %v, want %v", err, ErrRefreshTokenInvalid)
+	}
+	sessions, err := db.GetSessions(login.User.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 0 {
+		t.Errorf("the user still has %d sessions", len(sessions))
+	}
+}
+
+func TestRevokeRefreshTokenEndsSession(t *testing.T) {
+	db, login := newTestLogin(t)
+	rotated, err := db.RotateRefreshToken(login.RefreshToken, Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// revoking with an old token of the family ends the session as well
+	err = db.RevokeRefreshToken(login.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.RotateRefreshToken(rotated.RefreshToken, Device{})
+	if !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("the token of a revoked session returned %v, want %v", err, ErrRefreshTokenInvalid)
+	}
+}
+
+func TestUnknownRefreshToken(t *testing.T) {
+	db, _ := newTestLogin(t)
+	_, err := db.RotateRefreshToken("not a token", Device{})
+	if !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("got %v, want %v", err, ErrRefreshTokenInvalid)
+	}
+}
+
+func TestRotationKeepsScopes(t *testing.T) {
+	db := NewMemoryDB()
+	_, err := db.CreateUser("user@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	login, err := db.LoginUser("user@example.com", "password", Device{}, []string{"chirps:write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := db.RotateRefreshToken(login.RefreshToken, Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(rotated.Session.Scopes, []string{"chirps:write"}) {
+		t.Errorf("the rotated session has scopes %v, want chirps:write", rotated.Session.Scopes)
+	}
+}
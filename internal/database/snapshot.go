@@ -0,0 +1,122 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Snapshotter is implemented by stores that can write a consistent
+// point-in-time copy of themselves to a file
+type Snapshotter interface {
+	Snapshot(path string) error
+}
+
+var _ Snapshotter = (*DB)(nil)
+
+// Snapshot writes the current state to path as a database file that
+// Restore accepts. Writers are blocked while it is taken, readers are not.
+// It never overwrites a file that is already at path.
+func (db *DB) Snapshot(path string) error {
+	db.mux.RLock()
+	data, err := json.Marshal(db.state)
+	db.mux.RUnlock()
+	if err != nil {
+		return err
+	}
+	data, err = db.storage.seal(data)
+	if err != nil {
+		return err
+	}
+	return writeNewFile(path, data)
+}
+
+// writeNewFile creates a file at path with data, failing if the file
+// exists. A file that couldn't be written completely is removed.
+func writeNewFile(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// Restore validates the snapshot at snapshotPath and installs it as the
+// database at path. The current file is kept as the .bak backup and its
+// log is archived, so nothing is lost if the wrong snapshot was picked.
+// It fails with ErrLocked while a server has the database open.
+func Restore(snapshotPath string, path string, options ...Option) error {
+	file := newFileStorage(path, options...)
+	snapshot, err := readSnapshot(snapshotPath, file.keys)
+	if err != nil {
+		return fmt.Errorf("%s is not a valid snapshot: %w", snapshotPath, err)
+	}
+	err = validateSnapshot(snapshot)
+	if err != nil {
+		return fmt.Errorf("%s is not a valid snapshot: %w", snapshotPath, err)
+	}
+
+	err = file.acquireLock()
+	if err != nil {
+		return err
+	}
+	defer file.close()
+
+	err = file.write(snapshot)
+	if err != nil {
+		return err
+	}
+	return file.wal.archive()
+}
+
+// readSnapshot reads a snapshot file, migrating it if it was taken by an
+// older version
+func readSnapshot(path string, keys *Keyring) (DBStructure, error) {
+	doc, _, err := readDBFile(path, keys)
+	if err != nil {
+		return DBStructure{}, err
+	}
+	err = doc.migrate()
+	if err != nil {
+		return DBStructure{}, err
+	}
+	return doc.decode()
+}
+
+// validateSnapshot checks that records are filed under their own ids
+func validateSnapshot(dbStructure DBStructure) error {
+	for id, chirp := range dbStructure.Chirps {
+		if chirp.Id != id {
+			return fmt.Errorf("chirp %s is stored under id %s", chirp.Id, id)
+		}
+	}
+	for id, user := range dbStructure.Users {
+		if user.Id != id {
+			return fmt.Errorf("user %s is stored under id %s", user.Id, id)
+		}
+	}
+	for id, session := range dbStructure.Sessions {
+		if session.Id != id {
+			return fmt.Errorf("session %s is stored under id %s", session.Id, id)
+		}
+	}
+	for id, token := range dbStructure.PersonalTokens {
+		if token.Id != id {
+			return fmt.Errorf("personal token %s is stored under id %s", token.Id, id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "database.json")
+	snapshotPath := filepath.Join(dir, "snapshot.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateChirp("in the snapshot", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Snapshot(snapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Snapshot(snapshotPath)
+	if !errors.Is(err, os.ErrExist) {
+		t.Errorf("taking a snapshot over an existing one returned %v, want %v", err, os.ErrExist)
+	}
+	_, err = db.CreateChirp("after the snapshot", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Restore(snapshotPath, path)
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("restoring while the database is open returned %v, want %v", err, ErrLocked)
+	}
+	db.Close()
+	err = Restore(snapshotPath, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 1 || chirps[0].Body != "in the snapshot" {
+		t.Errorf("the restored database has chirps %v", chirps)
+	}
+}
+
+func TestValidateSnapshot(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*DBStructure)
+		valid  bool
+	}{
+		{"valid", func(*DBStructure) {}, true},
+		{"chirp under another id", func(s *DBStructure) { s.Chirps["2"] = Chirp{Id: "1"} }, false},
+		{"user under another id", func(s *DBStructure) { s.Users["2"] = User{Id: "1"} }, false},
+		{"session under another id", func(s *DBStructure) { s.Sessions["2"] = Session{Id: "1"} }, false},
+		{"personal token under another id", func(s *DBStructure) { s.PersonalTokens["2"] = PersonalToken{Id: "1"} }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbStructure := newDBStructure()
+			dbStructure.Chirps["1"] = Chirp{Id: "1"}
+			dbStructure.Users["1"] = User{Id: "1"}
+			dbStructure.Sessions["1"] = Session{Id: "1"}
+			dbStructure.PersonalTokens["1"] = PersonalToken{Id: "1"}
+			tt.modify(&dbStructure)
+			err := validateSnapshot(dbStructure)
+			if (err == nil) != tt.valid {
+				t.Errorf("validateSnapshot returned %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
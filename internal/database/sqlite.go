@@ -0,0 +1,990 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteDB is a Store backed by an embedded SQLite database
+type SQLiteDB struct {
+	db  *sql.DB
+	ids IDGenerator
+}
+
+var _ Store = (*SQLiteDB)(nil)
+
+// NewSQLiteDB opens the SQLite database at path, creating it if needed,
+// and applies any pending schema migrations
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows one writer at a time, so a single connection
+	// saves us from SQLITE_BUSY errors under concurrent requests
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec("PRAGMA journal_mode = WAL; PRAGMA busy_timeout = 5000;")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	err = migrate(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteDB{db: db, ids: CounterIDs{}}, nil
+}
+
+// SetIDGenerator changes how ids are generated for new records.
+// The default is CounterIDs. It must be called before the database is
+// shared between goroutines.
+func (s *SQLiteDB) SetIDGenerator(ids IDGenerator) {
+	s.ids = ids
+}
+
+// nextID advances the named sequence inside tx and generates an id from it
+func (s *SQLiteDB) nextID(tx *sql.Tx, sequence string) (ID, uint64, error) {
+	seq := uint64(0)
+	err := tx.QueryRow("UPDATE sequences SET value = value + 1 WHERE name = ? RETURNING value", sequence).Scan(&seq)
+	if err != nil {
+		return "", 0, err
+	}
+	id, err := s.ids.NewID(seq)
+	return id, seq, err
+}
+
+// Close releases the underlying database handle
+func (s *SQLiteDB) Close() error {
+	return s.db.Close()
+}
+
+// chirpColumns are the columns scanChirp expects, in order
+const chirpColumns = "id, body, author_id, created_at, updated_at, deleted_at, deleted_by"
+
+// userColumns are the columns scanUser expects, in order
+const userColumns = "id, email, password, is_chirpy_red, roles, created_at, updated_at"
+
+// sessionColumns are the columns of a session, in the order of scanSession
+const sessionColumns = "id, user_id, token_hash, user_agent, ip, scopes, created_at, last_used_at, expires_at"
+
+// personalTokenColumns are the columns of a personal access token, in the
+// order of scanPersonalToken
+const personalTokenColumns = "id, user_id, name, token_hash, scopes, created_at, last_used_at"
+
+// mfaColumns are the columns of a user's two-factor authentication, in the
+// order of scanMFA
+const mfaColumns = "secret, enabled_at, last_step, recovery_code_hashes, failed_attempts, locked_until, used_challenges"
+
+// CreateChirp creates a new chirp and saves it to disk
+func (s *SQLiteDB) CreateChirp(body string, authorId ID) (Chirp, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	id, seq, err := s.nextID(tx, chirpSequence)
+	if err != nil {
+		return Chirp{}, err
+	}
+	now := time.Now().UTC()
+	_, err = tx.Exec("INSERT INTO chirps (id, seq, body, author_id, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+		id, seq, body, authorId, now, now)
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return Chirp{}, err
+	}
+	return Chirp{
+		CreatedAt: now,
+		UpdatedAt: now,
+		Body:      body,
+		Id:        id,
+		AuthorId:  authorId,
+	}, nil
+}
+
+// DeleteChirp moves a chirp to the trash, where its author can restore it
+// until ChirpRestoreWindow has passed
+func (s *SQLiteDB) DeleteChirp(id ID, userId ID, moderate bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	chirp, err := scanChirp(tx.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && chirp.IsDeleted()) {
+		return ErrChirpNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if chirp.AuthorId != userId && !moderate {
+		return ErrNotChirpAuthor
+	}
+	_, err = tx.Exec("UPDATE chirps SET deleted_at = ?, deleted_by = ? WHERE id = ?", time.Now().UTC(), userId, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RestoreChirp takes a chirp back out of the trash
+func (s *SQLiteDB) RestoreChirp(id ID, userId ID, moderate bool) (Chirp, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	chirp, err := scanChirp(tx.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrChirpNotFound
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+	if chirp.AuthorId != userId && !moderate {
+		return Chirp{}, ErrNotChirpAuthor
+	}
+	if !chirp.IsDeleted() {
+		return Chirp{}, ErrChirpNotDeleted
+	}
+	if chirp.isModerated() && !moderate {
+		return Chirp{}, ErrChirpModerated
+	}
+	if time.Since(*chirp.DeletedAt) > ChirpRestoreWindow {
+		return Chirp{}, ErrRestoreWindowPassed
+	}
+	_, err = tx.Exec("UPDATE chirps SET deleted_at = NULL, deleted_by = NULL WHERE id = ?", id)
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp.DeletedAt = nil
+	chirp.DeletedBy = ""
+	return chirp, nil
+}
+
+// PurgeDeletedChirps permanently removes the chirps deleted before
+// deletedBefore and returns how many there were
+func (s *SQLiteDB) PurgeDeletedChirps(deletedBefore time.Time) (int, error) {
+	result, err := s.db.Exec("DELETE FROM chirps WHERE deleted_at IS NOT NULL AND deleted_at < ?", deletedBefore.UTC())
+	if err != nil {
+		return 0, err
+	}
+	purged, err := result.RowsAffected()
+	return int(purged), err
+}
+
+// GetChirps returns all chirps in the database that aren't in the trash
+func (s *SQLiteDB) GetChirps() ([]Chirp, error) {
+	return s.queryChirps("SELECT " + chirpColumns + " FROM chirps WHERE deleted_at IS NULL ORDER BY seq")
+}
+
+// GetChirpsByAuthor returns the chirps written by the given user
+// that aren't in the trash
+func (s *SQLiteDB) GetChirpsByAuthor(authorId ID) ([]Chirp, error) {
+	return s.queryChirps("SELECT "+chirpColumns+" FROM chirps WHERE author_id = ? AND deleted_at IS NULL ORDER BY seq",
+		authorId)
+}
+
+func (s *SQLiteDB) queryChirps(query string, args ...any) ([]Chirp, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return []Chirp{}, err
+	}
+	defer rows.Close()
+
+	chirps := []Chirp{}
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return []Chirp{}, err
+		}
+		chirps = append(chirps, chirp)
+	}
+	return chirps, rows.Err()
+}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanChirp(row scanner) (Chirp, error) {
+	chirp := Chirp{}
+	deletedAt := sql.NullTime{}
+	deletedBy := sql.NullString{}
+	err := row.Scan(&chirp.Id, &chirp.Body, &chirp.AuthorId, &chirp.CreatedAt, &chirp.UpdatedAt, &deletedAt, &deletedBy)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if deletedAt.Valid {
+		chirp.DeletedAt = &deletedAt.Time
+	}
+	chirp.DeletedBy = ID(deletedBy.String)
+	return chirp, nil
+}
+
+// GetSingleChirp returns the chirp, or ErrChirpDeleted if it is in the trash
+func (s *SQLiteDB) GetSingleChirp(id ID) (Chirp, error) {
+	chirp, err := scanChirp(s.db.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrChirpNotFound
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+	if chirp.IsDeleted() {
+		return Chirp{}, ErrChirpDeleted
+	}
+	return chirp, nil
+}
+
+// CreateUser creates a new user and saves it to disk
+func (s *SQLiteDB) CreateUser(email string, password string) (User, error) {
+	_, err := s.getUserByEmail(email)
+	if err == nil {
+		return User{}, errors.New("a user with this email already exists")
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return User{}, err
+	}
+
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	id, seq, err := s.nextID(tx, userSequence)
+	if err != nil {
+		return User{}, err
+	}
+	now := time.Now().UTC()
+	_, err = tx.Exec("INSERT INTO users (id, seq, email, password, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+		id, seq, email, hashedPassword, now, now)
+	if err != nil {
+		return User{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return User{}, err
+	}
+	return User{
+		CreatedAt: now,
+		UpdatedAt: now,
+		Password:  hashedPassword,
+		Email:     email,
+		Id:        id,
+	}, nil
+}
+
+// UpdateUser user updates the given user and returns the updated user
+func (s *SQLiteDB) UpdateUser(id ID, email string, password string) (User, error) {
+	hashedPassword := ""
+	if len(password) > 0 {
+		hashed, err := hashPassword(password)
+		if err != nil {
+			return User{}, err
+		}
+		hashedPassword = hashed
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if len(hashedPassword) > 0 {
+		user.Password = hashedPassword
+	}
+	if len(email) > 0 {
+		var owner ID
+		err := tx.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&owner)
+		if err == nil && owner != user.Id {
+			return User{}, errors.New("a user with this email already exists")
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return User{}, err
+		}
+		user.Email = email
+	}
+	user.UpdatedAt = time.Now().UTC()
+	_, err = tx.Exec("UPDATE users SET email = ?, password = ?, updated_at = ? WHERE id = ?",
+		user.Email, user.Password, user.UpdatedAt, user.Id)
+	if err != nil {
+		return User{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (s *SQLiteDB) UpgradeUserToRed(id ID) error {
+	result, err := s.db.Exec("UPDATE users SET is_chirpy_red = 1, updated_at = ? WHERE id = ?", time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// LoginUser checks the user's password and starts a new session for them
+// on the device. It returns the session's refresh token, which is only
+// stored hashed. Users with two-factor authentication get ErrMFARequired
+// and a Login without a session instead, see StartSession.
+func (s *SQLiteDB) LoginUser(email string, password string, device Device, scopes []string) (Login, error) {
+	user, err := s.getUserByEmail(email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Login{}, errors.New("the user doesn't exist")
+	}
+	if err != nil {
+		return Login{}, err
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	if err != nil {
+		return Login{}, err
+	}
+	mfa, err := scanMFA(s.db.QueryRow("SELECT "+mfaColumns+" FROM user_mfa WHERE user_id = ?", user.Id))
+	if err != nil {
+		return Login{}, err
+	}
+	if mfa.IsEnabled() {
+		return Login{User: user}, ErrMFARequired
+	}
+	return s.startSession(user, device, scopes)
+}
+
+// StartSession starts a new session for the user on the device, once
+// their second factor was checked after LoginUser. passwordStamp is the
+// User.PasswordStamp of the password they logged in with; if the password
+// changed since, StartSession fails with ErrPasswordChanged.
+func (s *SQLiteDB) StartSession(userId ID, passwordStamp string, device Device, scopes []string) (Login, error) {
+	user, err := s.GetUser(userId)
+	if err != nil {
+		return Login{}, err
+	}
+	if user.PasswordStamp() != passwordStamp {
+		return Login{}, ErrPasswordChanged
+	}
+	return s.startSession(user, device, scopes)
+}
+
+// startSession starts a session for the user as they were when they were
+// authenticated, failing if their password changed since
+func (s *SQLiteDB) startSession(user User, device Device, scopes []string) (Login, error) {
+	session, refreshToken, err := newSession(user.Id, device, scopes)
+	if err != nil {
+		return Login{}, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Login{}, err
+	}
+	defer tx.Rollback()
+
+	password := ""
+	err = tx.QueryRow("SELECT password FROM users WHERE id = ?", user.Id).Scan(&password)
+	if errors.Is(err, sql.ErrNoRows) || password != user.Password {
+		return Login{}, ErrPasswordChanged
+	}
+	if err != nil {
+		return Login{}, err
+	}
+
+	id, seq, err := s.nextID(tx, sessionSequence)
+	if err != nil {
+		return Login{}, err
+	}
+	session.Id = id
+	_, err = tx.Exec("INSERT INTO sessions (seq, "+sessionColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		seq, session.Id, session.UserId, session.TokenHash, session.UserAgent, session.IP, strings.Join(session.Scopes, " "),
+		session.CreatedAt, session.LastUsedAt, session.ExpiresAt)
+	if err != nil {
+		return Login{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return Login{}, err
+	}
+	return Login{User: user, Session: session, RefreshToken: refreshToken}, nil
+}
+
+// RevokeRefreshToken ends the session the refresh token belongs to, even
+// if it is an old one the session has rotated away from
+func (s *SQLiteDB) RevokeRefreshToken(token string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	id := ID("")
+	hash := hashToken(token)
+	err = tx.QueryRow(`SELECT id FROM sessions WHERE token_hash = ?
+		UNION SELECT session_id FROM session_rotated_tokens WHERE token_hash = ?`, hash, hash).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = deleteSQLiteSession(tx, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one of the same
+// session and returns the session's user along with it. Reusing a token
+// that was already exchanged revokes the session with ErrRefreshTokenReused.
+func (s *SQLiteDB) RotateRefreshToken(token string, device Device) (Login, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Login{}, err
+	}
+	defer tx.Rollback()
+
+	hash := hashToken(token)
+	session, err := scanSession(tx.QueryRow("SELECT "+sessionColumns+" FROM sessions WHERE token_hash = ?", hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Login{}, s.revokeReusedToken(tx, hash)
+	}
+	if err != nil {
+		return Login{}, err
+	}
+	if session.IsExpired() {
+		return Login{}, ErrRefreshTokenExpired
+	}
+	user, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", session.UserId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Login{}, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return Login{}, err
+	}
+
+	newToken, err := session.rotate(device.IP)
+	if err != nil {
+		return Login{}, err
+	}
+	_, err = tx.Exec("INSERT INTO session_rotated_tokens (token_hash, session_id, rotated_at) VALUES (?, ?, ?)",
+		hash, session.Id, session.LastUsedAt)
+	if err != nil {
+		return Login{}, err
+	}
+	_, err = tx.Exec(`DELETE FROM session_rotated_tokens WHERE session_id = ? AND token_hash NOT IN (
+		SELECT token_hash FROM session_rotated_tokens WHERE session_id = ? ORDER BY rotated_at DESC LIMIT ?)`,
+		session.Id, session.Id, keepRotatedHashes)
+	if err != nil {
+		return Login{}, err
+	}
+	_, err = tx.Exec("UPDATE sessions SET token_hash = ?, last_used_at = ?, ip = ? WHERE id = ?",
+		session.TokenHash, session.LastUsedAt, session.IP, session.Id)
+	if err != nil {
+		return Login{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return Login{}, err
+	}
+	return Login{User: user, Session: session, RefreshToken: newToken}, nil
+}
+
+// revokeReusedToken ends the session that hash was rotated away from, if
+// any, and returns the error RotateRefreshToken reports for hash
+func (s *SQLiteDB) revokeReusedToken(tx *sql.Tx, hash string) error {
+	id := ID("")
+	err := tx.QueryRow("SELECT session_id FROM session_rotated_tokens WHERE token_hash = ?", hash).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return err
+	}
+	err = deleteSQLiteSession(tx, id)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	return ErrRefreshTokenReused
+}
+
+// deleteSQLiteSession removes a session together with its rotated tokens
+func deleteSQLiteSession(tx *sql.Tx, id ID) error {
+	_, err := tx.Exec("DELETE FROM session_rotated_tokens WHERE session_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM sessions WHERE id = ?", id)
+	return err
+}
+
+// GetSessions returns the user's sessions that haven't expired, oldest first
+func (s *SQLiteDB) GetSessions(userId ID) ([]Session, error) {
+	rows, err := s.db.Query("SELECT "+sessionColumns+" FROM sessions WHERE user_id = ? AND expires_at > ? ORDER BY seq",
+		userId, time.Now().UTC())
+	if err != nil {
+		return []Session{}, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return []Session{}, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// DeleteSession ends one of the user's sessions
+func (s *SQLiteDB) DeleteSession(id ID, userId ID) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	owner := ID("")
+	err = tx.QueryRow("SELECT user_id FROM sessions WHERE id = ?", id).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && owner != userId) {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	err = deleteSQLiteSession(tx, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteSessions ends all of the user's sessions, logging them out
+// everywhere, and returns how many there were
+func (s *SQLiteDB) DeleteSessions(userId ID) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM session_rotated_tokens WHERE session_id IN (SELECT id FROM sessions WHERE user_id = ?)", userId)
+	if err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", userId)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(deleted), tx.Commit()
+}
+
+func scanSession(row scanner) (Session, error) {
+	session := Session{}
+	scopes := ""
+	err := row.Scan(&session.Id, &session.UserId, &session.TokenHash, &session.UserAgent, &session.IP, &scopes,
+		&session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt)
+	if err != nil {
+		return Session{}, err
+	}
+	session.Scopes = strings.Fields(scopes)
+	return session, nil
+}
+
+// CreatePersonalToken creates a personal access token for the user and
+// returns it together with the token itself, which is only stored hashed
+func (s *SQLiteDB) CreatePersonalToken(userId ID, name string, scopes []string) (PersonalToken, string, error) {
+	token, secret, err := newPersonalToken(userId, name, scopes)
+	if err != nil {
+		return PersonalToken{}, "", err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return PersonalToken{}, "", err
+	}
+	defer tx.Rollback()
+
+	exists := false
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", userId).Scan(&exists)
+	if err != nil {
+		return PersonalToken{}, "", err
+	}
+	if !exists {
+		return PersonalToken{}, "", ErrUserNotFound
+	}
+	id, seq, err := s.nextID(tx, personalTokenSequence)
+	if err != nil {
+		return PersonalToken{}, "", err
+	}
+	token.Id = id
+	_, err = tx.Exec("INSERT INTO personal_tokens (seq, "+personalTokenColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		seq, token.Id, token.UserId, token.Name, token.TokenHash, strings.Join(token.Scopes, " "),
+		token.CreatedAt, token.LastUsedAt)
+	if err != nil {
+		return PersonalToken{}, "", err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return PersonalToken{}, "", err
+	}
+	return token, secret, nil
+}
+
+// GetPersonalTokens returns the user's personal access tokens, oldest first
+func (s *SQLiteDB) GetPersonalTokens(userId ID) ([]PersonalToken, error) {
+	rows, err := s.db.Query("SELECT "+personalTokenColumns+" FROM personal_tokens WHERE user_id = ? ORDER BY seq", userId)
+	if err != nil {
+		return []PersonalToken{}, err
+	}
+	defer rows.Close()
+
+	tokens := []PersonalToken{}
+	for rows.Next() {
+		token, err := scanPersonalToken(rows)
+		if err != nil {
+			return []PersonalToken{}, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// UsePersonalToken returns the personal access token a request is made
+// with and records that it was used
+func (s *SQLiteDB) UsePersonalToken(token string) (PersonalToken, error) {
+	found, err := scanPersonalToken(s.db.QueryRow("SELECT "+personalTokenColumns+" FROM personal_tokens WHERE token_hash = ?", hashToken(token)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return PersonalToken{}, ErrPersonalTokenInvalid
+	}
+	if err != nil {
+		return PersonalToken{}, err
+	}
+	if !found.use() {
+		return found, nil
+	}
+	_, err = s.db.Exec("UPDATE personal_tokens SET last_used_at = ? WHERE id = ?", found.LastUsedAt, found.Id)
+	if err != nil {
+		return PersonalToken{}, err
+	}
+	return found, nil
+}
+
+// DeletePersonalToken revokes one of the user's personal access tokens
+func (s *SQLiteDB) DeletePersonalToken(id ID, userId ID) error {
+	result, err := s.db.Exec("DELETE FROM personal_tokens WHERE id = ? AND user_id = ?", id, userId)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrPersonalTokenNotFound
+	}
+	return nil
+}
+
+// EnrollMFA starts setting up two-factor authentication for the user with
+// a new secret, which EnableMFA enables. It returns the user.
+func (s *SQLiteDB) EnrollMFA(userId ID, secret string) (User, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", userId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	current, err := scanMFA(tx.QueryRow("SELECT "+mfaColumns+" FROM user_mfa WHERE user_id = ?", userId))
+	if err != nil {
+		return User{}, err
+	}
+	if current.IsEnabled() {
+		return User{}, ErrMFAEnabled
+	}
+	err = putSQLiteMFA(tx, userId, &MFA{Secret: secret})
+	if err != nil {
+		return User{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// GetMFA returns the user's two-factor authentication
+func (s *SQLiteDB) GetMFA(userId ID) (MFA, error) {
+	mfa, err := scanMFA(s.db.QueryRow("SELECT "+mfaColumns+" FROM user_mfa WHERE user_id = ?", userId))
+	if err != nil {
+		return MFA{}, err
+	}
+	if mfa == nil {
+		return MFA{}, ErrMFANotEnrolled
+	}
+	return *mfa, nil
+}
+
+// EnableMFA enables two-factor authentication for the user once they
+// entered a code of the secret from EnrollMFA, from time step step
+func (s *SQLiteDB) EnableMFA(userId ID, step int64, recoveryCodeHashes []string) error {
+	return s.updateMFA(userId, func(mfa *MFA, now time.Time) error {
+		return mfa.enable(step, recoveryCodeHashes, now)
+	})
+}
+
+// UseMFAStep accepts a code of the user's authenticator from time step
+// step, once
+func (s *SQLiteDB) UseMFAStep(userId ID, step int64) error {
+	return s.updateMFA(userId, func(mfa *MFA, now time.Time) error {
+		return mfa.useStep(step, now)
+	})
+}
+
+// UseRecoveryCode accepts the user's recovery code with the hash and uses
+// it up
+func (s *SQLiteDB) UseRecoveryCode(userId ID, hash string) error {
+	return s.updateMFA(userId, func(mfa *MFA, now time.Time) error {
+		return mfa.useRecoveryCode(hash, now)
+	})
+}
+
+// UseMFAChallenge marks the user's MFA token with jti id, which expires at
+// expiresAt, as exchanged for a login, once
+func (s *SQLiteDB) UseMFAChallenge(userId ID, id string, expiresAt time.Time) error {
+	return s.updateMFA(userId, func(mfa *MFA, now time.Time) error {
+		return mfa.useChallenge(id, expiresAt, now)
+	})
+}
+
+// RecordMFAFailure counts a wrong code of the user, which locks their
+// second factor after too many in a row
+func (s *SQLiteDB) RecordMFAFailure(userId ID) error {
+	return s.updateMFA(userId, (*MFA).recordFailure)
+}
+
+// updateMFA applies change to the user's two-factor authentication and
+// saves it unless change fails
+func (s *SQLiteDB) updateMFA(userId ID, change func(mfa *MFA, now time.Time) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	mfa, err := scanMFA(tx.QueryRow("SELECT "+mfaColumns+" FROM user_mfa WHERE user_id = ?", userId))
+	if err != nil {
+		return err
+	}
+	if mfa == nil {
+		return ErrMFANotEnrolled
+	}
+	err = change(mfa, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	err = putSQLiteMFA(tx, userId, mfa)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DisableMFA turns off the user's two-factor authentication
+func (s *SQLiteDB) DisableMFA(userId ID) error {
+	result, err := s.db.Exec("DELETE FROM user_mfa WHERE user_id = ?", userId)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrMFANotEnrolled
+	}
+	return nil
+}
+
+// scanMFA scans a user's two-factor authentication, which is nil for
+// users that didn't set it up
+func scanMFA(row scanner) (*MFA, error) {
+	mfa := &MFA{}
+	enabledAt := sql.NullTime{}
+	lockedUntil := sql.NullTime{}
+	hashes := ""
+	challenges := ""
+	err := row.Scan(&mfa.Secret, &enabledAt, &mfa.LastStep, &hashes, &mfa.FailedAttempts, &lockedUntil, &challenges)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if enabledAt.Valid {
+		mfa.EnabledAt = &enabledAt.Time
+	}
+	if lockedUntil.Valid {
+		mfa.LockedUntil = &lockedUntil.Time
+	}
+	mfa.RecoveryCodeHashes = strings.Fields(hashes)
+	for _, challenge := range strings.Fields(challenges) {
+		id, expiresAt, _ := strings.Cut(challenge, ":")
+		unix, err := strconv.ParseInt(expiresAt, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("used MFA challenge %q: %w", challenge, err)
+		}
+		if mfa.UsedChallenges == nil {
+			mfa.UsedChallenges = map[string]time.Time{}
+		}
+		mfa.UsedChallenges[id] = time.Unix(unix, 0).UTC()
+	}
+	return mfa, nil
+}
+
+// putSQLiteMFA inserts or replaces a user's two-factor authentication
+func putSQLiteMFA(tx *sql.Tx, userId ID, mfa *MFA) error {
+	challenges := []string{}
+	for id, expiresAt := range mfa.UsedChallenges {
+		challenges = append(challenges, fmt.Sprintf("%s:%d", id, expiresAt.Unix()))
+	}
+	_, err := tx.Exec(`INSERT INTO user_mfa (user_id, `+mfaColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET secret = excluded.secret, enabled_at = excluded.enabled_at,
+		last_step = excluded.last_step, recovery_code_hashes = excluded.recovery_code_hashes,
+		failed_attempts = excluded.failed_attempts, locked_until = excluded.locked_until,
+		used_challenges = excluded.used_challenges`,
+		userId, mfa.Secret, mfa.EnabledAt, mfa.LastStep, strings.Join(mfa.RecoveryCodeHashes, " "),
+		mfa.FailedAttempts, mfa.LockedUntil, strings.Join(challenges, " "))
+	return err
+}
+
+func scanPersonalToken(row scanner) (PersonalToken, error) {
+	token := PersonalToken{}
+	scopes := ""
+	lastUsedAt := sql.NullTime{}
+	err := row.Scan(&token.Id, &token.UserId, &token.Name, &token.TokenHash, &scopes, &token.CreatedAt, &lastUsedAt)
+	if err != nil {
+		return PersonalToken{}, err
+	}
+	token.Scopes = strings.Fields(scopes)
+	if lastUsedAt.Valid {
+		token.LastUsedAt = &lastUsedAt.Time
+	}
+	return token, nil
+}
+
+// GetUser returns the user with the id
+func (s *SQLiteDB) GetUser(id ID) (User, error) {
+	user, err := s.getUser("id = ?", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	return user, err
+}
+
+// GetUserByEmail returns the user with the email
+func (s *SQLiteDB) GetUserByEmail(email string) (User, error) {
+	user, err := s.getUserByEmail(email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	return user, err
+}
+
+// SetUserRoles replaces the roles the user was granted
+func (s *SQLiteDB) SetUserRoles(id ID, roles []string) (User, error) {
+	roles, err := normalizeRoles(roles)
+	if err != nil {
+		return User{}, err
+	}
+	result, err := s.db.Exec("UPDATE users SET roles = ?, updated_at = ? WHERE id = ?",
+		strings.Join(roles, " "), time.Now().UTC(), id)
+	if err != nil {
+		return User{}, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return User{}, err
+	}
+	if affected == 0 {
+		return User{}, ErrUserNotFound
+	}
+	return s.GetUser(id)
+}
+
+func (s *SQLiteDB) getUserByEmail(email string) (User, error) {
+	return s.getUser("email = ?", email)
+}
+
+// getUser returns the single user matching the where clause
+func (s *SQLiteDB) getUser(where string, args ...any) (User, error) {
+	return scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE "+where, args...))
+}
+
+func scanUser(row scanner) (User, error) {
+	user := User{}
+	roles := ""
+	err := row.Scan(&user.Id, &user.Email, &user.Password, &user.IsRedUser, &roles, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		return User{}, err
+	}
+	if fields := strings.Fields(roles); len(fields) > 0 {
+		user.Roles = fields
+	}
+	return user, nil
+}
@@ -0,0 +1,256 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// sqliteMigrations are applied in order, each exactly once. The version of
+// a migration is its position in the slice plus one, so existing entries
+// must never be edited or reordered: append a new one instead.
+var sqliteMigrations = []string{
+	// 1: initial schema, mirroring DBStructure
+	`CREATE TABLE users (
+		id INTEGER PRIMARY KEY,
+		email TEXT NOT NULL UNIQUE COLLATE NOCASE,
+		password TEXT NOT NULL,
+		refresh_token TEXT NOT NULL DEFAULT '',
+		expiration_time DATETIME,
+		is_chirpy_red INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE chirps (
+		id INTEGER PRIMARY KEY,
+		body TEXT NOT NULL,
+		author_id INTEGER NOT NULL
+	);`,
+	// 2: lookups by author and by refresh token
+	`CREATE INDEX chirps_author_id ON chirps (author_id);
+	CREATE INDEX users_refresh_token ON users (refresh_token);`,
+	// 3: creation and edit timestamps, backfilled for existing rows
+	`ALTER TABLE chirps ADD COLUMN created_at DATETIME;
+	ALTER TABLE chirps ADD COLUMN updated_at DATETIME;
+	ALTER TABLE users ADD COLUMN created_at DATETIME;
+	ALTER TABLE users ADD COLUMN updated_at DATETIME;
+	UPDATE chirps SET created_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP;
+	UPDATE users SET created_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP;`,
+	// 4: soft delete for chirps
+	`ALTER TABLE chirps ADD COLUMN deleted_at DATETIME;
+	ALTER TABLE chirps ADD COLUMN deleted_by INTEGER;
+	CREATE INDEX chirps_deleted_at ON chirps (deleted_at);`,
+	// 5: string ids handed out by an IDGenerator from persisted sequences.
+	// seq keeps the creation order now that ids no longer sort numerically.
+	`CREATE TABLE sequences (
+		name TEXT PRIMARY KEY,
+		value INTEGER NOT NULL
+	);
+	INSERT INTO sequences (name, value) SELECT 'users', COALESCE(MAX(id), 0) FROM users;
+	INSERT INTO sequences (name, value) SELECT 'chirps', COALESCE(MAX(id), 0) FROM chirps;
+	CREATE TABLE users_new (
+		id TEXT PRIMARY KEY,
+		seq INTEGER NOT NULL,
+		email TEXT NOT NULL UNIQUE COLLATE NOCASE,
+		password TEXT NOT NULL,
+		refresh_token TEXT NOT NULL DEFAULT '',
+		expiration_time DATETIME,
+		is_chirpy_red INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME,
+		updated_at DATETIME
+	);
+	INSERT INTO users_new (id, seq, email, password, refresh_token, expiration_time, is_chirpy_red, created_at, updated_at)
+		SELECT CAST(id AS TEXT), id, email, password, refresh_token, expiration_time, is_chirpy_red, created_at, updated_at
+		FROM users;
+	DROP TABLE users;
+	ALTER TABLE users_new RENAME TO users;
+	CREATE INDEX users_refresh_token ON users (refresh_token);
+	CREATE INDEX users_seq ON users (seq);
+	CREATE TABLE chirps_new (
+		id TEXT PRIMARY KEY,
+		seq INTEGER NOT NULL,
+		body TEXT NOT NULL,
+		author_id TEXT NOT NULL,
+		created_at DATETIME,
+		updated_at DATETIME,
+		deleted_at DATETIME,
+		deleted_by TEXT
+	);
+	INSERT INTO chirps_new (id, seq, body, author_id, created_at, updated_at, deleted_at, deleted_by)
+		SELECT CAST(id AS TEXT), id, body, CAST(author_id AS TEXT), created_at, updated_at, deleted_at, CAST(deleted_by AS TEXT)
+		FROM chirps;
+	DROP TABLE chirps;
+	ALTER TABLE chirps_new RENAME TO chirps;
+	CREATE INDEX chirps_author_id ON chirps (author_id);
+	CREATE INDEX chirps_deleted_at ON chirps (deleted_at);
+	CREATE INDEX chirps_seq ON chirps (seq);`,
+	// 6: sessions keyed by the hash of their refresh token; the tokens of
+	// existing users are moved over by sqliteDataMigrations
+	`CREATE TABLE sessions (
+		id TEXT PRIMARY KEY,
+		seq INTEGER NOT NULL,
+		user_id TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		user_agent TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL
+	);
+	CREATE INDEX sessions_user_id ON sessions (user_id);
+	INSERT INTO sequences (name, value) VALUES ('sessions', 0);`,
+	// 7: users no longer hold refresh tokens
+	`DROP INDEX users_refresh_token;
+	ALTER TABLE users DROP COLUMN refresh_token;
+	ALTER TABLE users DROP COLUMN expiration_time;`,
+	// 8: the refresh tokens sessions rotated away from, to detect reuse
+	`CREATE TABLE session_rotated_tokens (
+		token_hash TEXT PRIMARY KEY,
+		session_id TEXT NOT NULL,
+		rotated_at DATETIME NOT NULL
+	);
+	CREATE INDEX session_rotated_tokens_session_id ON session_rotated_tokens (session_id, rotated_at);`,
+	// 9: where sessions were last used from
+	`ALTER TABLE sessions ADD COLUMN ip TEXT NOT NULL DEFAULT '';`,
+	// 10: roles, separated by spaces
+	`ALTER TABLE users ADD COLUMN roles TEXT NOT NULL DEFAULT '';`,
+	// 11: scopes, separated by spaces; sessions from before scopes keep
+	// every scope there was
+	`ALTER TABLE sessions ADD COLUMN scopes TEXT NOT NULL DEFAULT '';
+	UPDATE sessions SET scopes = 'account:write admin chirps:read chirps:write';`,
+	// 12: personal access tokens, keyed by their hash like sessions
+	`CREATE TABLE personal_tokens (
+		id TEXT PRIMARY KEY,
+		seq INTEGER NOT NULL,
+		user_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME
+	);
+	CREATE INDEX personal_tokens_user_id ON personal_tokens (user_id);
+	INSERT INTO sequences (name, value) VALUES ('personal_tokens', 0);`,
+	// 13: two-factor authentication of the users that set it up; recovery
+	// code hashes are separated by spaces
+	`CREATE TABLE user_mfa (
+		user_id TEXT PRIMARY KEY,
+		secret TEXT NOT NULL,
+		enabled_at DATETIME,
+		last_step INTEGER NOT NULL DEFAULT 0,
+		recovery_code_hashes TEXT NOT NULL DEFAULT '',
+		failed_attempts INTEGER NOT NULL DEFAULT 0,
+		locked_until DATETIME
+	);`,
+	// 14: listing sessions and personal access tokens takes account:read,
+	// which whoever had account:write gets
+	`UPDATE sessions SET scopes = 'account:read ' || scopes
+		WHERE ' ' || scopes || ' ' LIKE '% account:write %' AND ' ' || scopes || ' ' NOT LIKE '% account:read %';
+	UPDATE personal_tokens SET scopes = 'account:read ' || scopes
+		WHERE ' ' || scopes || ' ' LIKE '% account:write %' AND ' ' || scopes || ' ' NOT LIKE '% account:read %';`,
+	// 15: the MFA tokens that were exchanged for a login, as jti:expiry
+	// pairs separated by spaces
+	`ALTER TABLE user_mfa ADD COLUMN used_challenges TEXT NOT NULL DEFAULT '';`,
+}
+
+// sqliteDataMigrations run after the statements of the migration with the
+// same version, in the same transaction, for changes SQL can't express
+var sqliteDataMigrations = map[int]func(tx *sql.Tx) error{
+	6: moveRefreshTokensToSessions,
+}
+
+func moveRefreshTokensToSessions(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, refresh_token, expiration_time FROM users WHERE refresh_token != ''")
+	if err != nil {
+		return err
+	}
+	type token struct {
+		userId    ID
+		token     string
+		expiresAt sql.NullTime
+	}
+	tokens := []token{}
+	for rows.Next() {
+		t := token{}
+		err := rows.Scan(&t.userId, &t.token, &t.expiresAt)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		tokens = append(tokens, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for i, t := range tokens {
+		seq := i + 1
+		_, err := tx.Exec(`INSERT INTO sessions (id, seq, user_id, token_hash, created_at, last_used_at, expires_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			strconv.Itoa(seq), seq, t.userId, hashToken(t.token), now, now, t.expiresAt.Time)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("UPDATE sequences SET value = ? WHERE name = 'sessions'", len(tokens))
+	return err
+}
+
+// migrate brings the schema up to date, recording each applied
+// version in schema_migrations
+func migrate(db *sql.DB) error {
+	return migrateTo(db, len(sqliteMigrations))
+}
+
+// migrateTo applies the migrations up to and including version target
+func migrateTo(db *sql.DB, target int) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at DATETIME NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	current := 0
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current)
+	if err != nil {
+		return err
+	}
+	if current > len(sqliteMigrations) {
+		return fmt.Errorf("database schema version %d is newer than this build supports (%d)", current, len(sqliteMigrations))
+	}
+
+	for i := current; i < target; i++ {
+		version := i + 1
+		err := applyMigration(db, version, sqliteMigrations[i])
+		if err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(db *sql.DB, version int, statements string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(statements)
+	if err != nil {
+		return err
+	}
+	if dataMigration, ok := sqliteDataMigrations[version]; ok {
+		err = dataMigration(tx)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES (?, CURRENT_TIMESTAMP)", version)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,227 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	fixturePassword      = "$2a$10$RTCjgoRO/jidpF...Cn4euOiFgqjTfFCpLLoDfbHP0X2mMHc7f.f2"
+	fixtureRefreshHash   = "92a91bf63f42d4fd99920a875902484cbeafc4c07be228d7fdac53968d7e01ac"
+	fixturePersonalHash  = "f6bbd9bb8fcbb3ab7f054c6b097c66c077232977befa5851d7370c48e3355678"
+	fixtureSQLiteTime    = "2024-01-02 03:04:05"
+	fixtureSQLiteExpires = "2100-01-01 00:00:00"
+)
+
+// sqliteFixture fills a database at a schema version with the records of
+// the JSON fixtures, the way that version stored them
+func sqliteFixture(version int) string {
+	r := strings.NewReplacer(
+		"$password", "'"+fixturePassword+"'",
+		"$refresh", "'"+fixtureRefreshHash+"'",
+		"$personal", "'"+fixturePersonalHash+"'",
+		"$time", "'"+fixtureSQLiteTime+"'",
+		"$expires", "'"+fixtureSQLiteExpires+"'",
+	)
+	switch {
+	case version <= 2:
+		return r.Replace(`
+		INSERT INTO users (id, email, password, refresh_token, expiration_time, is_chirpy_red) VALUES
+			(1, 'a@example.com', $password, 'legacy-refresh-token', $expires, 0),
+			(2, 'b@example.com', $password, '', NULL, 1);
+		INSERT INTO chirps (id, body, author_id) VALUES (1, 'first', 1), (2, 'second', 2);`)
+	case version == 3:
+		return r.Replace(`
+		INSERT INTO users (id, email, password, refresh_token, expiration_time, is_chirpy_red, created_at, updated_at) VALUES
+			(1, 'a@example.com', $password, 'legacy-refresh-token', $expires, 0, $time, $time),
+			(2, 'b@example.com', $password, '', NULL, 1, $time, $time);
+		INSERT INTO chirps (id, body, author_id, created_at, updated_at) VALUES
+			(1, 'first', 1, $time, $time),
+			(2, 'second', 2, $time, $time);`)
+	case version == 4:
+		return r.Replace(`
+		INSERT INTO users (id, email, password, refresh_token, expiration_time, is_chirpy_red, created_at, updated_at) VALUES
+			(1, 'a@example.com', $password, 'legacy-refresh-token', $expires, 0, $time, $time),
+			(2, 'b@example.com', $password, '', NULL, 1, $time, $time);
+		INSERT INTO chirps (id, body, author_id, created_at, updated_at, deleted_at, deleted_by) VALUES
+			(1, 'first', 1, $time, $time, NULL, NULL),
+			(2, 'second', 2, $time, $time, NULL, NULL),
+			(3, 'deleted', 1, $time, $time, $time, 1);`)
+	}
+
+	// from version 5 on ids are strings with a separate seq
+	fixture := `
+		INSERT OR REPLACE INTO sequences (name, value) VALUES ('users', 2), ('chirps', 3);
+		INSERT INTO chirps (id, seq, body, author_id, created_at, updated_at, deleted_at, deleted_by) VALUES
+			('1', 1, 'first', '1', $time, $time, NULL, NULL),
+			('2', 2, 'second', '2', $time, $time, NULL, NULL),
+			('3', 3, 'deleted', '1', $time, $time, $time, '1');`
+	switch {
+	case version == 5:
+		fixture += `
+		INSERT INTO users (id, seq, email, password, refresh_token, expiration_time, is_chirpy_red, created_at, updated_at) VALUES
+			('1', 1, 'a@example.com', $password, 'legacy-refresh-token', $expires, 0, $time, $time),
+			('2', 2, 'b@example.com', $password, '', NULL, 1, $time, $time);`
+	case version == 6:
+		// the refresh tokens were moved to sessions, but the columns are left
+		fixture += `
+		INSERT INTO users (id, seq, email, password, refresh_token, expiration_time, is_chirpy_red, created_at, updated_at) VALUES
+			('1', 1, 'a@example.com', $password, '', NULL, 0, $time, $time),
+			('2', 2, 'b@example.com', $password, '', NULL, 1, $time, $time);`
+	case version <= 9:
+		fixture += `
+		INSERT INTO users (id, seq, email, password, is_chirpy_red, created_at, updated_at) VALUES
+			('1', 1, 'a@example.com', $password, 0, $time, $time),
+			('2', 2, 'b@example.com', $password, 1, $time, $time);`
+	default:
+		fixture += `
+		INSERT INTO users (id, seq, email, password, is_chirpy_red, created_at, updated_at, roles) VALUES
+			('1', 1, 'a@example.com', $password, 0, $time, $time, ''),
+			('2', 2, 'b@example.com', $password, 1, $time, $time, 'admin');`
+	}
+	switch {
+	case version == 5:
+	case version <= 8:
+		fixture += `
+		INSERT OR REPLACE INTO sequences (name, value) VALUES ('sessions', 1);
+		INSERT INTO sessions (id, seq, user_id, token_hash, user_agent, created_at, last_used_at, expires_at) VALUES
+			('1', 1, '1', $refresh, '', $time, $time, $expires);`
+	case version <= 10:
+		fixture += `
+		INSERT OR REPLACE INTO sequences (name, value) VALUES ('sessions', 1);
+		INSERT INTO sessions (id, seq, user_id, token_hash, user_agent, created_at, last_used_at, expires_at, ip) VALUES
+			('1', 1, '1', $refresh, '', $time, $time, $expires, '');`
+	case version <= 13:
+		fixture += `
+		INSERT OR REPLACE INTO sequences (name, value) VALUES ('sessions', 1);
+		INSERT INTO sessions (id, seq, user_id, token_hash, user_agent, created_at, last_used_at, expires_at, ip, scopes) VALUES
+			('1', 1, '1', $refresh, '', $time, $time, $expires, '', 'account:write chirps:read chirps:write');`
+	default:
+		fixture += `
+		INSERT OR REPLACE INTO sequences (name, value) VALUES ('sessions', 1);
+		INSERT INTO sessions (id, seq, user_id, token_hash, user_agent, created_at, last_used_at, expires_at, ip, scopes) VALUES
+			('1', 1, '1', $refresh, '', $time, $time, $expires, '', 'account:read account:write chirps:read chirps:write');`
+	}
+	if version >= 12 {
+		fixture += `
+		INSERT OR REPLACE INTO sequences (name, value) VALUES ('personal_tokens', 1);
+		INSERT INTO personal_tokens (id, seq, user_id, name, token_hash, scopes, created_at, last_used_at) VALUES
+			('1', 1, '1', 'script', $personal, 'chirps:read chirps:write', $time, NULL);`
+	}
+	if version >= 13 {
+		fixture += `
+		INSERT INTO user_mfa (user_id, secret) VALUES ('2', '` + rfc6238Secret + `');`
+	}
+	return r.Replace(fixture)
+}
+
+// sqliteFixtureContents is what the fixture of a schema version holds
+func sqliteFixtureContents(version int) fixture {
+	want := fixture{
+		timestamps:    version >= 3,
+		deletedChirp:  version >= 4,
+		scopes:        allScopes,
+		personalToken: version >= 12,
+		mfaEnrolled:   version >= 13,
+	}
+	if version >= 11 {
+		want.scopes = limitedScopes
+	}
+	return want
+}
+
+// newSQLiteFixture creates a database at a schema version with its fixture
+func newSQLiteFixture(t *testing.T, version int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "chirpy.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = migrateTo(db, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(sqliteFixture(version))
+	if err != nil {
+		t.Fatalf("the fixture of version %d: %v", version, err)
+	}
+	return path
+}
+
+func sqliteSchemaVersion(t *testing.T, path string) int {
+	t.Helper()
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	version := 0
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestMigrateSQLite(t *testing.T) {
+	for version := 1; version <= len(sqliteMigrations); version++ {
+		t.Run(fmt.Sprintf("version %d", version), func(t *testing.T) {
+			path := newSQLiteFixture(t, version)
+			store, err := NewSQLiteDB(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			checkMigrated(t, store, sqliteFixtureContents(version))
+			if got := sqliteSchemaVersion(t, path); got != len(sqliteMigrations) {
+				t.Errorf("the database is at schema version %d, want %d", got, len(sqliteMigrations))
+			}
+		})
+	}
+}
+
+func TestMigrateSQLiteFromScratch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chirpy.db")
+	store, err := NewSQLiteDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if got := sqliteSchemaVersion(t, path); got != len(sqliteMigrations) {
+		t.Errorf("the database is at schema version %d, want %d", got, len(sqliteMigrations))
+	}
+	user, err := store.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Id != "1" {
+		t.Errorf("the first user got id %s, want 1", user.Id)
+	}
+}
+
+func TestMigrateSQLiteFromNewerVersion(t *testing.T) {
+	path := newSQLiteFixture(t, len(sqliteMigrations))
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES (?, CURRENT_TIMESTAMP)", len(sqliteMigrations)+1)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewSQLiteDB(path)
+	if err == nil {
+		store.Close()
+		t.Fatal("a database from a newer version was opened")
+	}
+	if !strings.Contains(err.Error(), "newer than this build") {
+		t.Errorf("NewSQLiteDB returned %v, want a newer version error", err)
+	}
+}
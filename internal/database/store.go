@@ -0,0 +1,121 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrLocked is returned when another process has the database open
+	ErrLocked = errors.New("the database is in use by another process")
+	// ErrReadOnly is returned by every write to a read-only database
+	ErrReadOnly = errors.New("the database is open in read-only mode")
+
+	// ErrChirpNotFound is returned for chirps that never existed or were purged
+	ErrChirpNotFound = errors.New("chirp not found")
+	// ErrChirpDeleted is returned for chirps that are in the trash
+	ErrChirpDeleted = errors.New("chirp was deleted")
+	// ErrChirpNotDeleted is returned when restoring a chirp that isn't in the trash
+	ErrChirpNotDeleted = errors.New("chirp is not deleted")
+	// ErrNotChirpAuthor is returned when someone other than the author
+	// tries to delete or restore a chirp
+	ErrNotChirpAuthor = errors.New("the user is not authorised to change this chirp")
+	// ErrChirpModerated is returned when an author tries to restore a
+	// chirp a moderator deleted
+	ErrChirpModerated = errors.New("the chirp was removed by a moderator")
+	// ErrRestoreWindowPassed is returned when restoring a chirp deleted
+	// more than ChirpRestoreWindow ago
+	ErrRestoreWindowPassed = errors.New("the chirp was deleted too long ago to be restored")
+
+	// ErrUserNotFound is returned for users that don't exist
+	ErrUserNotFound = errors.New("user not found")
+
+	// ErrRefreshTokenInvalid is returned for refresh tokens that don't
+	// belong to any session
+	ErrRefreshTokenInvalid = errors.New("the refresh token is not valid")
+	// ErrRefreshTokenExpired is returned for refresh tokens of sessions
+	// that have expired
+	ErrRefreshTokenExpired = errors.New("the refresh token has expired")
+	// ErrRefreshTokenReused is returned when a refresh token that was
+	// already rotated is used again. Its session is revoked.
+	ErrRefreshTokenReused = errors.New("the refresh token was already used, the session has been revoked")
+	// ErrSessionNotFound is returned for sessions that don't exist or
+	// belong to another user
+	ErrSessionNotFound = errors.New("session not found")
+
+	// ErrPersonalTokenInvalid is returned for personal access tokens that
+	// don't exist or were revoked
+	ErrPersonalTokenInvalid = errors.New("the personal access token is not valid")
+	// ErrPersonalTokenNotFound is returned for personal access tokens that
+	// don't exist or belong to another user
+	ErrPersonalTokenNotFound = errors.New("personal access token not found")
+
+	// ErrMFARequired is returned by LoginUser for users with two-factor
+	// authentication, whose session only starts once they entered a code
+	ErrMFARequired = errors.New("the user has two-factor authentication enabled, a code is required")
+	// ErrMFANotEnrolled is returned when confirming, checking or disabling
+	// two-factor authentication the user hasn't set up
+	ErrMFANotEnrolled = errors.New("two-factor authentication is not set up")
+	// ErrMFAEnabled is returned when setting up two-factor authentication
+	// again without disabling it first
+	ErrMFAEnabled = errors.New("two-factor authentication is already enabled")
+	// ErrMFACodeInvalid is returned for wrong codes
+	ErrMFACodeInvalid = errors.New("the code is not valid")
+	// ErrMFACodeReused is returned for authenticator codes that were
+	// already used
+	ErrMFACodeReused = errors.New("the code was already used, wait for the next one")
+	// ErrMFALocked is returned after too many wrong codes in a row
+	ErrMFALocked = errors.New("too many wrong codes, try again later")
+	// ErrMFAChallengeUsed is returned for MFA tokens that were already
+	// exchanged for a login
+	ErrMFAChallengeUsed = errors.New("the MFA token was already used, log in again")
+	// ErrPasswordChanged is returned by StartSession when the user's
+	// password changed since they entered it
+	ErrPasswordChanged = errors.New("the password changed since logging in, log in again")
+)
+
+// ChirpRestoreWindow is how long a deleted chirp stays in the trash, where
+// its author can restore it, before it is purged for good
+const ChirpRestoreWindow = 30 * 24 * time.Hour
+
+// Store is the set of operations the handlers need from a storage backend.
+// *DB satisfies it for both the JSON file and the in-memory backends.
+type Store interface {
+	CreateChirp(body string, authorId ID) (Chirp, error)
+	DeleteChirp(id ID, userId ID, moderate bool) error
+	RestoreChirp(id ID, userId ID, moderate bool) (Chirp, error)
+	PurgeDeletedChirps(deletedBefore time.Time) (int, error)
+	GetChirps() ([]Chirp, error)
+	GetChirpsByAuthor(authorId ID) ([]Chirp, error)
+	GetSingleChirp(id ID) (Chirp, error)
+
+	CreateUser(email string, password string) (User, error)
+	GetUser(id ID) (User, error)
+	GetUserByEmail(email string) (User, error)
+	SetUserRoles(id ID, roles []string) (User, error)
+	UpdateUser(id ID, email string, password string) (User, error)
+	UpgradeUserToRed(id ID) error
+	LoginUser(email string, password string, device Device, scopes []string) (Login, error)
+	StartSession(userId ID, passwordStamp string, device Device, scopes []string) (Login, error)
+	RevokeRefreshToken(token string) error
+	RotateRefreshToken(token string, device Device) (Login, error)
+	GetSessions(userId ID) ([]Session, error)
+	DeleteSession(id ID, userId ID) error
+	DeleteSessions(userId ID) (int, error)
+	CreatePersonalToken(userId ID, name string, scopes []string) (PersonalToken, string, error)
+	GetPersonalTokens(userId ID) ([]PersonalToken, error)
+	UsePersonalToken(token string) (PersonalToken, error)
+	DeletePersonalToken(id ID, userId ID) error
+	EnrollMFA(userId ID, secret string) (User, error)
+	GetMFA(userId ID) (MFA, error)
+	EnableMFA(userId ID, step int64, recoveryCodeHashes []string) error
+	UseMFAStep(userId ID, step int64) error
+	UseRecoveryCode(userId ID, hash string) error
+	UseMFAChallenge(userId ID, id string, expiresAt time.Time) error
+	RecordMFAFailure(userId ID) error
+	DisableMFA(userId ID) error
+
+	SetIDGenerator(ids IDGenerator)
+}
+
+var _ Store = (*DB)(nil)
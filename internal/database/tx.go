@@ -0,0 +1,372 @@
+package database
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrTxNotWritable is returned by the write methods of a Tx passed to View
+var ErrTxNotWritable = errors.New("the transaction is read-only")
+
+// Tx is a view of the database inside Update or View. Writes made through
+// it are only visible to the same Tx until the callback returns, and are
+// then committed together as a single log entry. A Tx must not be used
+// after its callback has returned.
+type Tx struct {
+	db       *DB
+	writable bool
+	// records written in this transaction; nil marks a deletion
+	chirps    map[ID]*Chirp
+	users     map[ID]*User
+	sessions  map[ID]*Session
+	sequences map[string]uint64
+	changes   []change
+
+	personalTokens map[ID]*PersonalToken
+}
+
+// Update runs fn in a read-write transaction. If fn returns nil all of its
+// writes are committed atomically, otherwise they are all discarded.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	tx := newTx(db, true)
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+	if len(tx.changes) == 0 {
+		return nil
+	}
+	return db.commit(tx.changes...)
+}
+
+// View runs fn in a read-only transaction
+func (db *DB) View(fn func(tx *Tx) error) error {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	return fn(newTx(db, false))
+}
+
+func newTx(db *DB, writable bool) *Tx {
+	return &Tx{
+		db:        db,
+		writable:  writable,
+		chirps:    map[ID]*Chirp{},
+		users:     map[ID]*User{},
+		sessions:  map[ID]*Session{},
+		sequences: map[string]uint64{},
+
+		personalTokens: map[ID]*PersonalToken{},
+	}
+}
+
+// Chirp returns the chirp with the given id
+func (tx *Tx) Chirp(id ID) (Chirp, bool) {
+	if chirp, ok := tx.chirps[id]; ok {
+		if chirp == nil {
+			return Chirp{}, false
+		}
+		return *chirp, true
+	}
+	chirp, ok := tx.db.state.Chirps[id]
+	return chirp, ok
+}
+
+// Chirps returns every chirp ordered by id
+func (tx *Tx) Chirps() []Chirp {
+	chirps := []Chirp{}
+	for id := range tx.db.state.Chirps {
+		if _, ok := tx.chirps[id]; !ok {
+			chirps = append(chirps, tx.db.state.Chirps[id])
+		}
+	}
+	for _, chirp := range tx.chirps {
+		if chirp != nil {
+			chirps = append(chirps, *chirp)
+		}
+	}
+	sortChirps(chirps)
+	return chirps
+}
+
+// ChirpsByAuthor returns the chirps written by the given user ordered by id
+func (tx *Tx) ChirpsByAuthor(authorId ID) []Chirp {
+	chirps := []Chirp{}
+	for id := range tx.db.indexes.chirpsByAuthor[authorId] {
+		if _, ok := tx.chirps[id]; !ok {
+			chirps = append(chirps, tx.db.state.Chirps[id])
+		}
+	}
+	for _, chirp := range tx.chirps {
+		if chirp != nil && chirp.AuthorId == authorId {
+			chirps = append(chirps, *chirp)
+		}
+	}
+	sortChirps(chirps)
+	return chirps
+}
+
+// User returns the user with the given id
+func (tx *Tx) User(id ID) (User, bool) {
+	if user, ok := tx.users[id]; ok {
+		if user == nil {
+			return User{}, false
+		}
+		return *user, true
+	}
+	user, ok := tx.db.state.Users[id]
+	return user, ok
+}
+
+// Users returns every user ordered by id
+func (tx *Tx) Users() []User {
+	users := []User{}
+	for id := range tx.db.state.Users {
+		if _, ok := tx.users[id]; !ok {
+			users = append(users, tx.db.state.Users[id])
+		}
+	}
+	for _, user := range tx.users {
+		if user != nil {
+			users = append(users, *user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Id.Less(users[j].Id)
+	})
+	return users
+}
+
+// UserByEmail returns the user with the given email, ignoring case
+func (tx *Tx) UserByEmail(email string) (User, bool) {
+	key := normalizeEmail(email)
+	for _, user := range tx.users {
+		if user != nil && normalizeEmail(user.Email) == key {
+			return *user, true
+		}
+	}
+	id, ok := tx.db.indexes.usersByEmail[key]
+	if !ok {
+		return User{}, false
+	}
+	user, ok := tx.User(id)
+	if !ok || normalizeEmail(user.Email) != key {
+		return User{}, false
+	}
+	return user, true
+}
+
+// Session returns the session with the given id
+func (tx *Tx) Session(id ID) (Session, bool) {
+	if session, ok := tx.sessions[id]; ok {
+		if session == nil {
+			return Session{}, false
+		}
+		return *session, true
+	}
+	session, ok := tx.db.state.Sessions[id]
+	return session, ok
+}
+
+// SessionByTokenHash returns the session whose current refresh token, or
+// one it rotated away from, has the hash
+func (tx *Tx) SessionByTokenHash(hash string) (Session, bool) {
+	for _, session := range tx.sessions {
+		if session != nil && session.hasTokenHash(hash) {
+			return *session, true
+		}
+	}
+	id, ok := tx.db.indexes.sessionsByTokenHash[hash]
+	if !ok {
+		return Session{}, false
+	}
+	session, ok := tx.Session(id)
+	if !ok || !session.hasTokenHash(hash) {
+		return Session{}, false
+	}
+	return session, true
+}
+
+// SessionsByUser returns the sessions of the given user, oldest first
+func (tx *Tx) SessionsByUser(userId ID) []Session {
+	sessions := []Session{}
+	for id := range tx.db.indexes.sessionsByUser[userId] {
+		if _, ok := tx.sessions[id]; !ok {
+			sessions = append(sessions, tx.db.state.Sessions[id])
+		}
+	}
+	for _, session := range tx.sessions {
+		if session != nil && session.UserId == userId {
+			sessions = append(sessions, *session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Id.Less(sessions[j].Id)
+	})
+	return sessions
+}
+
+// PersonalToken returns the personal access token with the given id
+func (tx *Tx) PersonalToken(id ID) (PersonalToken, bool) {
+	if token, ok := tx.personalTokens[id]; ok {
+		if token == nil {
+			return PersonalToken{}, false
+		}
+		return *token, true
+	}
+	token, ok := tx.db.state.PersonalTokens[id]
+	return token, ok
+}
+
+// PersonalTokenByHash returns the personal access token with the hash
+func (tx *Tx) PersonalTokenByHash(hash string) (PersonalToken, bool) {
+	for _, token := range tx.personalTokens {
+		if token != nil && token.TokenHash == hash {
+			return *token, true
+		}
+	}
+	id, ok := tx.db.indexes.personalTokensByHash[hash]
+	if !ok {
+		return PersonalToken{}, false
+	}
+	token, ok := tx.PersonalToken(id)
+	if !ok || token.TokenHash != hash {
+		return PersonalToken{}, false
+	}
+	return token, true
+}
+
+// PersonalTokensByUser returns the personal access tokens of the given
+// user, oldest first
+func (tx *Tx) PersonalTokensByUser(userId ID) []PersonalToken {
+	tokens := []PersonalToken{}
+	for id := range tx.db.indexes.personalTokensByUser[userId] {
+		if _, ok := tx.personalTokens[id]; !ok {
+			tokens = append(tokens, tx.db.state.PersonalTokens[id])
+		}
+	}
+	for _, token := range tx.personalTokens {
+		if token != nil && token.UserId == userId {
+			tokens = append(tokens, *token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Id.Less(tokens[j].Id)
+	})
+	return tokens
+}
+
+// PutChirp inserts or replaces a chirp
+func (tx *Tx) PutChirp(chirp Chirp) error {
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	tx.chirps[chirp.Id] = &chirp
+	tx.changes = append(tx.changes, putChirp(chirp))
+	return nil
+}
+
+// DeleteChirp removes a chirp if it exists
+func (tx *Tx) DeleteChirp(id ID) error {
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	tx.chirps[id] = nil
+	tx.changes = append(tx.changes, deleteChirp(id))
+	return nil
+}
+
+// PutUser inserts or replaces a user
+func (tx *Tx) PutUser(user User) error {
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	tx.users[user.Id] = &user
+	tx.changes = append(tx.changes, putUser(user))
+	return nil
+}
+
+// DeleteUser removes a user if it exists. Their chirps are left alone.
+func (tx *Tx) DeleteUser(id ID) error {
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	tx.users[id] = nil
+	tx.changes = append(tx.changes, deleteUser(id))
+	return nil
+}
+
+// PutSession inserts or replaces a session
+func (tx *Tx) PutSession(session Session) error {
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	tx.sessions[session.Id] = &session
+	tx.changes = append(tx.changes, putSession(session))
+	return nil
+}
+
+// DeleteSession removes a session if it exists
+func (tx *Tx) DeleteSession(id ID) error {
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	tx.sessions[id] = nil
+	tx.changes = append(tx.changes, deleteSession(id))
+	return nil
+}
+
+// PutPersonalToken inserts or replaces a personal access token
+func (tx *Tx) PutPersonalToken(token PersonalToken) error {
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	tx.personalTokens[token.Id] = &token
+	tx.changes = append(tx.changes, putPersonalToken(token))
+	return nil
+}
+
+// DeletePersonalToken removes a personal access token if it exists
+func (tx *Tx) DeletePersonalToken(id ID) error {
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	tx.personalTokens[id] = nil
+	tx.changes = append(tx.changes, deletePersonalToken(id))
+	return nil
+}
+
+// nextID advances the named sequence and generates an id from it
+func (tx *Tx) nextID(sequence string) (ID, error) {
+	seq := tx.sequence(sequence) + 1
+	err := tx.setSequence(sequence, seq)
+	if err != nil {
+		return "", err
+	}
+	return tx.db.ids.NewID(seq)
+}
+
+func (tx *Tx) sequence(name string) uint64 {
+	if value, ok := tx.sequences[name]; ok {
+		return value
+	}
+	return tx.db.state.Sequences[name]
+}
+
+func (tx *Tx) setSequence(name string, value uint64) error {
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	tx.sequences[name] = value
+	tx.changes = append(tx.changes, setSequence(name, value))
+	return nil
+}
+
+func sortChirps(chirps []Chirp) {
+	sort.Slice(chirps, func(i, j int) bool {
+		return chirps[i].Id.Less(chirps[j].Id)
+	})
+}
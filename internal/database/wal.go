@@ -0,0 +1,369 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	opPutChirp    = "put_chirp"
+	opDeleteChirp = "delete_chirp"
+	opPutUser     = "put_user"
+	opDeleteUser  = "delete_user"
+	opSetSequence = "set_sequence"
+
+	opPutSession    = "put_session"
+	opDeleteSession = "delete_session"
+
+	opPutPersonalToken    = "put_personal_token"
+	opDeletePersonalToken = "delete_personal_token"
+)
+
+// compactAfter is the number of log entries after which the log is folded
+// into a new snapshot of the database file
+const compactAfter = 1000
+
+// keepLogSegments is how many compacted log segments are kept as history
+const keepLogSegments = 10
+
+// change is a single mutation of the database. Each change carries the
+// full new value of the record, so replaying one twice is harmless.
+type change struct {
+	Op       string   `json:"op"`
+	Id       ID       `json:"id,omitempty"`
+	Chirp    *Chirp   `json:"chirp,omitempty"`
+	User     *User    `json:"user,omitempty"`
+	Session  *Session `json:"session,omitempty"`
+	Sequence string   `json:"sequence,omitempty"`
+	Value    uint64   `json:"value,omitempty"`
+
+	PersonalToken *PersonalToken `json:"personal_token,omitempty"`
+}
+
+// logEntry is one line of the write-ahead log: the changes of a single
+// operation, which are replayed all together or not at all
+type logEntry struct {
+	At      time.Time `json:"at"`
+	Changes []change  `json:"changes"`
+}
+
+func putChirp(chirp Chirp) change {
+	return change{Op: opPutChirp, Chirp: &chirp}
+}
+
+func deleteChirp(id ID) change {
+	return change{Op: opDeleteChirp, Id: id}
+}
+
+func putUser(user User) change {
+	return change{Op: opPutUser, User: &user}
+}
+
+func deleteUser(id ID) change {
+	return change{Op: opDeleteUser, Id: id}
+}
+
+func putSession(session Session) change {
+	return change{Op: opPutSession, Session: &session}
+}
+
+func deleteSession(id ID) change {
+	return change{Op: opDeleteSession, Id: id}
+}
+
+func putPersonalToken(token PersonalToken) change {
+	return change{Op: opPutPersonalToken, PersonalToken: &token}
+}
+
+func deletePersonalToken(id ID) change {
+	return change{Op: opDeletePersonalToken, Id: id}
+}
+
+func setSequence(name string, value uint64) change {
+	return change{Op: opSetSequence, Sequence: name, Value: value}
+}
+
+// validate checks that the change can be applied, which it then can be
+// to any state
+func (c change) validate() error {
+	switch c.Op {
+	case opPutChirp:
+		if c.Chirp == nil {
+			return errors.New("put_chirp without a chirp")
+		}
+	case opPutUser:
+		if c.User == nil {
+			return errors.New("put_user without a user")
+		}
+	case opPutSession:
+		if c.Session == nil {
+			return errors.New("put_session without a session")
+		}
+	case opPutPersonalToken:
+		if c.PersonalToken == nil {
+			return errors.New("put_personal_token without a personal_token")
+		}
+	case opDeleteChirp, opDeleteUser, opDeleteSession, opDeletePersonalToken, opSetSequence:
+	default:
+		return fmt.Errorf("unknown operation %q", c.Op)
+	}
+	return nil
+}
+
+// apply performs a change that passed validate on the in-memory state
+func (dbStructure *DBStructure) apply(c change) {
+	switch c.Op {
+	case opPutChirp:
+		dbStructure.Chirps[c.Chirp.Id] = *c.Chirp
+	case opDeleteChirp:
+		delete(dbStructure.Chirps, c.Id)
+	case opPutUser:
+		dbStructure.Users[c.User.Id] = *c.User
+	case opDeleteUser:
+		delete(dbStructure.Users, c.Id)
+	case opPutSession:
+		dbStructure.Sessions[c.Session.Id] = *c.Session
+	case opDeleteSession:
+		delete(dbStructure.Sessions, c.Id)
+	case opPutPersonalToken:
+		dbStructure.PersonalTokens[c.PersonalToken.Id] = *c.PersonalToken
+	case opDeletePersonalToken:
+		delete(dbStructure.PersonalTokens, c.Id)
+	case opSetSequence:
+		if dbStructure.Sequences == nil {
+			dbStructure.Sequences = map[string]uint64{}
+		}
+		dbStructure.Sequences[c.Sequence] = c.Value
+	}
+}
+
+// applyEntry performs a line of the write-ahead log on the in-memory state
+func (dbStructure *DBStructure) applyEntry(line []byte) error {
+	entry := logEntry{}
+	err := json.Unmarshal(line, &entry)
+	if err != nil {
+		return err
+	}
+	for _, c := range entry.Changes {
+		err = c.validate()
+		if err != nil {
+			return err
+		}
+	}
+	for _, c := range entry.Changes {
+		dbStructure.apply(c)
+	}
+	return nil
+}
+
+// errLogBroken is returned by append once a failed write couldn't be cut
+// off the log, as the next entry would end up on the same line
+var errLogBroken = errors.New("the write-ahead log couldn't be repaired after a failed write, reopen the database")
+
+// logFile is what the write-ahead log needs of the file it appends to
+type logFile interface {
+	io.WriteSeeker
+	io.Closer
+	Sync() error
+	Truncate(size int64) error
+}
+
+// writeAheadLog appends changes to a file, one JSON document per line
+type writeAheadLog struct {
+	path    string
+	file    logFile
+	entries int
+	// size is the length of the log up to the last complete entry
+	size int64
+	// keys encrypt each entry when set
+	keys *Keyring
+	// stale is set by replay when an entry isn't encrypted the way it
+	// would be written now
+	stale bool
+	// broken is set when a failed append couldn't be undone
+	broken bool
+}
+
+// replay calls applyEntry with every entry in the log. A torn last line,
+// left by a crash in the middle of an append, is skipped and later cut off
+// by open; damage anywhere else is reported as an error.
+func (wal *writeAheadLog) replay(applyEntry func(line []byte) error) error {
+	data, err := os.ReadFile(wal.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// anything after the last newline was never fully written
+			break
+		}
+		plaintext, stale, err := wal.keys.open(bytes.TrimSuffix(line, []byte("\n")))
+		if err == nil {
+			wal.stale = wal.stale || stale
+			err = applyEntry(plaintext)
+		}
+		if err != nil {
+			return fmt.Errorf("%s entry %d: %w", wal.path, wal.entries+1, err)
+		}
+		wal.size += int64(len(line))
+		wal.entries++
+	}
+	return nil
+}
+
+// open prepares the log for appending after the last complete entry
+func (wal *writeAheadLog) open() error {
+	file, err := os.OpenFile(wal.path, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = file.Truncate(wal.size)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	_, err = file.Seek(wal.size, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	wal.file = file
+	return nil
+}
+
+// append durably writes changes to the end of the log as a single entry
+func (wal *writeAheadLog) append(changes []change) error {
+	if wal.broken {
+		return errLogBroken
+	}
+	line, err := json.Marshal(logEntry{
+		At:      time.Now(),
+		Changes: changes,
+	})
+	if err != nil {
+		return err
+	}
+	line, err = wal.keys.seal(line)
+	if err != nil {
+		return err
+	}
+	_, err = wal.file.Write(append(line, '\n'))
+	if err == nil {
+		err = wal.file.Sync()
+	}
+	if err != nil {
+		return errors.Join(err, wal.discardTail())
+	}
+	wal.entries++
+	wal.size += int64(len(line)) + 1
+	return nil
+}
+
+// discardTail cuts off what a failed append may have written after the
+// last complete entry, so the entry isn't replayed later if it made it to
+// disk after all and the next one starts on a line of its own
+func (wal *writeAheadLog) discardTail() error {
+	err := wal.file.Truncate(wal.size)
+	if err == nil {
+		_, err = wal.file.Seek(wal.size, io.SeekStart)
+	}
+	if err != nil {
+		wal.broken = true
+		return fmt.Errorf("%w: %w", errLogBroken, err)
+	}
+	return nil
+}
+
+// rotate moves the current log aside as a history segment and starts an
+// empty one. It must only be called once the changes are in a snapshot.
+func (wal *writeAheadLog) rotate() error {
+	err := wal.file.Close()
+	if err != nil {
+		return err
+	}
+	err = wal.archive()
+	if err != nil {
+		return err
+	}
+	return wal.open()
+}
+
+// archive renames the log file to a history segment, if there is one
+func (wal *writeAheadLog) archive() error {
+	segment := fmt.Sprintf("%s.%d", wal.path, time.Now().UnixNano())
+	err := os.Rename(wal.path, segment)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	wal.entries = 0
+	wal.size = 0
+	wal.stale = false
+	err = syncDir(filepath.Dir(wal.path))
+	if err != nil {
+		return err
+	}
+	return wal.pruneSegments()
+}
+
+// segments lists the history segments, oldest first
+func (wal *writeAheadLog) segments() ([]string, error) {
+	segments, err := filepath.Glob(wal.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	// segment names differ only in a fixed width timestamp
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// segmentsSince lists the history segments archived after t, oldest first
+func (wal *writeAheadLog) segmentsSince(t time.Time) ([]string, error) {
+	segments, err := wal.segments()
+	if err != nil {
+		return nil, err
+	}
+	since := []string{}
+	for _, segment := range segments {
+		archivedAt, err := strconv.ParseInt(strings.TrimPrefix(segment, wal.path+"."), 10, 64)
+		if err == nil && archivedAt > t.UnixNano() {
+			since = append(since, segment)
+		}
+	}
+	return since, nil
+}
+
+// pruneSegments removes all but the newest keepLogSegments segments
+func (wal *writeAheadLog) pruneSegments() error {
+	segments, err := wal.segments()
+	if err != nil {
+		return err
+	}
+	for len(segments) > keepLogSegments {
+		err := os.Remove(segments[0])
+		if err != nil {
+			return err
+		}
+		segments = segments[1:]
+	}
+	return nil
+}
+
+func (wal *writeAheadLog) close() error {
+	if wal.file == nil {
+		return nil
+	}
+	return wal.file.Close()
+}
@@ -0,0 +1,14 @@
+// Package keyid derives ids for keys that weren't given one
+package keyid
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Derive returns a short id for key, which stays the same as long as the
+// key does. The id only has to tell keys apart, not keep them secret.
+func Derive(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
@@ -2,10 +2,15 @@ package main
 
 import (
 	"chirpy/handlers"
+	"chirpy/internal/auth"
 	"chirpy/internal/database"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -13,14 +18,35 @@ import (
 func main() {
 	// by default, godotenv will look for a file named .env in the current directory
 	godotenv.Load()
-	jwtSecret := os.Getenv("JWT_SECRET_KEY")
-	db, err := database.NewDB("database.json")
+	if len(os.Args) > 1 {
+		err := runCommand(os.Args[1], os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	tokens, err := accessTokens()
+	if err != nil {
+		log.Fatal(err)
+	}
+	backupDir := os.Getenv("BACKUP_DIR")
+	if len(backupDir) == 0 {
+		backupDir = "backups"
+	}
+	db, err := openDatabase()
 	if err != nil {
 		log.Fatal("Database crashed:", err)
 	}
+	ids, err := idGenerator()
+	if err != nil {
+		log.Fatal(err)
+	}
+	db.SetIDGenerator(ids)
 	apiCfg := &handlers.ApiConfig{
 		FileserverHits: 0,
-		JwtSecret:      jwtSecret,
+		Tokens:         tokens,
+		BackupDir:      backupDir,
 		Database:       db,
 	}
 	mux := http.NewServeMux()
@@ -29,7 +55,146 @@ func main() {
 		Addr:    "localhost:8080",
 	}
 	handlers.RegisterRoutes(mux, apiCfg)
+	go purgeDeletedChirps(db)
 
 	log.Println("Starting server on :8080")
 	server.ListenAndServe()
 }
+
+// openDatabase opens the storage backend selected by DB_BACKEND
+// ("json" by default, "sqlite" or "memory") at DB_PATH. When another
+// process holds the JSON database, DB_READ_ONLY_FALLBACK=true opens it
+// read-only instead of failing.
+func openDatabase() (database.Store, error) {
+	switch backend := os.Getenv("DB_BACKEND"); backend {
+	case "", "json":
+		options, err := fileOptions()
+		if err != nil {
+			return nil, err
+		}
+		path := databasePath("database.json")
+		db, err := database.NewDB(path, options...)
+		if errors.Is(err, database.ErrLocked) && os.Getenv("DB_READ_ONLY_FALLBACK") == "true" {
+			log.Printf("%s, opening it read-only", err)
+			return database.NewReadOnlyDB(path, options...)
+		}
+		return db, err
+	case "sqlite":
+		return database.NewSQLiteDB(databasePath("chirpy.db"))
+	case "memory":
+		return database.NewMemoryDB(), nil
+	default:
+		return nil, fmt.Errorf("unknown DB_BACKEND %q", backend)
+	}
+}
+
+// fileOptions configures encryption of the JSON database. The keys are
+// base64 encoded 256-bit keys, as printed by "chirpy generate-key", read
+// either one per line from DB_ENCRYPTION_KEYFILE or from DB_ENCRYPTION_KEY.
+// The first key encrypts; the others, and those in DB_ENCRYPTION_OLD_KEYS
+// (comma separated), only decrypt files written before a rotation. Backups
+// and old log segments keep the key they were written with, so a retired
+// key should stay in the list until they have been pruned.
+func fileOptions() ([]database.Option, error) {
+	keys := []string{}
+	if keyfile := os.Getenv("DB_ENCRYPTION_KEYFILE"); len(keyfile) > 0 {
+		data, err := os.ReadFile(keyfile)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if len(line) > 0 && !strings.HasPrefix(line, "#") {
+				keys = append(keys, line)
+			}
+		}
+	} else if key := os.Getenv("DB_ENCRYPTION_KEY"); len(key) > 0 {
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	for _, key := range strings.Split(os.Getenv("DB_ENCRYPTION_OLD_KEYS"), ",") {
+		if len(strings.TrimSpace(key)) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	keyring, err := database.NewKeyring(keys...)
+	if err != nil {
+		return nil, fmt.Errorf("encryption keys: %w", err)
+	}
+	return []database.Option{database.WithEncryption(keyring)}, nil
+}
+
+// signingKeyring returns the keys access tokens are signed with: those in
+// JWT_KEYS_FILE, or else the HS256 secret JWT_SECRET_KEY
+func signingKeyring() (*auth.Keyring, error) {
+	if keysFile := os.Getenv("JWT_KEYS_FILE"); len(keysFile) > 0 {
+		return auth.LoadKeyring(keysFile)
+	}
+	secret := os.Getenv("JWT_SECRET_KEY")
+	if len(secret) == 0 {
+		return nil, errors.New("either JWT_KEYS_FILE or JWT_SECRET_KEY must be set")
+	}
+	return auth.SecretKeyring(secret)
+}
+
+// accessTokens configures how access tokens are signed and checked.
+// JWT_AUDIENCE is the aud claim they carry ("chirpy" by default), and
+// JWT_LEEWAY how much clock skew is tolerated when checking their times
+// (30s by default).
+func accessTokens() (*auth.Tokens, error) {
+	keys, err := signingKeyring()
+	if err != nil {
+		return nil, err
+	}
+	audience := os.Getenv("JWT_AUDIENCE")
+	if len(audience) == 0 {
+		audience = auth.Issuer
+	}
+	leeway := 30 * time.Second
+	if value := os.Getenv("JWT_LEEWAY"); len(value) > 0 {
+		leeway, err = time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_LEEWAY: %w", err)
+		}
+	}
+	return &auth.Tokens{Keys: keys, Audience: audience, Leeway: leeway}, nil
+}
+
+// idGenerator returns the IDGenerator selected by ID_GENERATOR:
+// "counter" (the default) for 1, 2, 3... or "ulid" for ids that can't be
+// guessed
+func idGenerator() (database.IDGenerator, error) {
+	switch generator := os.Getenv("ID_GENERATOR"); generator {
+	case "", "counter":
+		return database.CounterIDs{}, nil
+	case "ulid":
+		return database.ULIDs{}, nil
+	default:
+		return nil, fmt.Errorf("unknown ID_GENERATOR %q", generator)
+	}
+}
+
+func databasePath(fallback string) string {
+	path := os.Getenv("DB_PATH")
+	if len(path) == 0 {
+		return fallback
+	}
+	return path
+}
+
+// purgeDeletedChirps permanently removes chirps that have been in the
+// trash for longer than they can be restored
+func purgeDeletedChirps(db database.Store) {
+	for range time.Tick(time.Hour) {
+		purged, err := db.PurgeDeletedChirps(time.Now().Add(-database.ChirpRestoreWindow))
+		if err != nil {
+			log.Printf("Error purging deleted chirps: %s", err)
+			continue
+		}
+		if purged > 0 {
+			log.Printf("Purged %d deleted chirps", purged)
+		}
+	}
+}